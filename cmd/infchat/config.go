@@ -2,12 +2,51 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
 	PrivateKeyPath string `toml:"private_key_path"`
+	// Encrypt the private key file using a passphrase. Existing plaintext
+	// key file is encrypted on the next start.
+	EncryptPrivateKey bool `toml:"encrypt_private_key"`
+	// Read the key file passphrase from the first line of this file instead
+	// of asking for it on the terminal. Use it (or INFCHAT_PASSPHRASE
+	// environment variable) if infchat runs without a terminal, e.g. in
+	// daemon mode. The file should be readable only by the owner.
+	PassphraseFile string `toml:"passphrase_file"`
+
+	HistoryDir string `toml:"history_dir"`
+	Nickname   string `toml:"nickname"`
+
+	// Files accepted using /accept are saved there.
+	DownloadDir string `toml:"download_dir"`
+
+	// Attachments of sent messages and ones fetched using /fetch are
+	// stored there and served to other peers.
+	AttachmentsDir string `toml:"attachments_dir"`
+	// Announce attachments of public channel messages in the DHT.
+	ProvideAttachments bool `toml:"provide_attachments"`
+
+	// Defaults to infinitychat.contacts next to the private key file.
+	ContactsPath string `toml:"contacts_path"`
+
+	// Messages that are not sent yet are saved there. Defaults to
+	// infinitychat.outbox next to the private key file.
+	OutboxPath string `toml:"outbox_path"`
+
+	// Known peers are saved there to speed up reconnection. Defaults to
+	// infinitychat.peers next to the private key file.
+	PeersPath string `toml:"peers_path"`
+
+	// Joined channels and the current buffer are saved there when we join or
+	// leave a channel and on exit.
+	// Defaults to infinitychat.state next to the private key file.
+	StatePath string `toml:"state_path"`
+
+	PresenceIntervalSecs int `toml:"presence_interval_secs"`
 
 	Swarm struct {
 		Bootstrap []string `toml:"bootstrap"`
@@ -26,14 +65,33 @@ type Config struct {
 	} `toml:"discovery"`
 
 	Channels struct {
+		// Channels to join on startup, in addition to ones joined before
+		// the previous shutdown.
+		Autojoin []string `toml:"autojoin"`
+
 		RejoinIntervalSecs   int `toml:"rejoin_interval_secs"`
 		AnnounceIntervalSecs int `toml:"Announce_interval_secs"`
 	} `toml:"channels"`
+
+	Daemon struct {
+		// Path to the Unix socket for the control API.
+		ControlSocket string `toml:"control_socket"`
+	} `toml:"daemon"`
+
+	// HTTP API, see the control package. Disabled if Listen is empty.
+	HTTP struct {
+		Listen string `toml:"listen"`
+		// Bearer token required for all requests.
+		Token string `toml:"token"`
+	} `toml:"http"`
 }
 
 func CreateDefaults() *Config {
 	cfg := new(Config)
 	cfg.PrivateKeyPath = "infinitychat.key"
+	cfg.HistoryDir = "infinitychat-history"
+	cfg.DownloadDir = "infinitychat-downloads"
+	cfg.AttachmentsDir = "infinitychat-attachments"
 	cfg.Swarm.Bootstrap = []string{
 		"/dnsaddr/bootstrap.libp2p.io/ipfs/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
 		"/dnsaddr/bootstrap.libp2p.io/ipfs/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
@@ -56,6 +114,8 @@ func CreateDefaults() *Config {
 	cfg.Discovery.MDNSIntervalSecs = 10
 	cfg.Channels.RejoinIntervalSecs = 30
 	cfg.Channels.AnnounceIntervalSecs = 5 * 60 /* 5 mins */
+	cfg.PresenceIntervalSecs = 2 * 60
+	cfg.Daemon.ControlSocket = "infinitychat.sock"
 
 	return cfg
 }
@@ -74,3 +134,31 @@ func ReadConfig(path string) (*Config, error) {
 	}
 	return cfg, nil
 }
+
+func (cfg *Config) contactsPath() string {
+	if cfg.ContactsPath != "" {
+		return cfg.ContactsPath
+	}
+	return filepath.Join(filepath.Dir(cfg.PrivateKeyPath), "infinitychat.contacts")
+}
+
+func (cfg *Config) statePath() string {
+	if cfg.StatePath != "" {
+		return cfg.StatePath
+	}
+	return filepath.Join(filepath.Dir(cfg.PrivateKeyPath), "infinitychat.state")
+}
+
+func (cfg *Config) peersPath() string {
+	if cfg.PeersPath != "" {
+		return cfg.PeersPath
+	}
+	return filepath.Join(filepath.Dir(cfg.PrivateKeyPath), "infinitychat.peers")
+}
+
+func (cfg *Config) outboxPath() string {
+	if cfg.OutboxPath != "" {
+		return cfg.OutboxPath
+	}
+	return filepath.Join(filepath.Dir(cfg.PrivateKeyPath), "infinitychat.outbox")
+}
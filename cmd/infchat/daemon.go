@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/foxcpp/infinitychat/control"
+	infchat "github.com/foxcpp/infinitychat/node"
+	golog "github.com/ipfs/go-log"
+	"golang.org/x/sys/unix"
+)
+
+// daemonCmd runs the node without any UI. It is controlled using the JSON-RPC
+// API on the Unix socket, see the control package.
+func daemonCmd(cfg *Config, args []string, p2pLog string, getPass passphraseReader) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := fs.String("socket", cfg.Daemon.ControlSocket, "Control socket path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	level, err := golog.LevelFromString(p2pLog)
+	if err != nil {
+		return err
+	}
+	golog.SetAllLoggers(level)
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	key, _, err := readKeyFile(cfg.PrivateKeyPath, getPass)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("daemon: %s does not exist, use infchat keygen to create it", cfg.PrivateKeyPath)
+		}
+		return fmt.Errorf("daemon: %w", err)
+	}
+
+	node, err := infchat.NewNode(nodeConfig(cfg, key, logger))
+	if err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+	defer node.Close()
+
+	srv := control.New(node, logger)
+	if err := srv.ListenUnix(*socket); err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+	defer os.Remove(*socket)
+	defer srv.Close()
+
+	if cfg.HTTP.Listen != "" {
+		if err := srv.ListenHTTP(cfg.HTTP.Listen, cfg.HTTP.Token); err != nil {
+			return fmt.Errorf("daemon: %w", err)
+		}
+		logger.Printf("Listening for HTTP API connections on %s", cfg.HTTP.Listen)
+	}
+
+	state, err := readState(cfg.statePath())
+	if err != nil {
+		logger.Printf("Failed to read state file: %v", err)
+	}
+
+	stateSub, err := subscribeState(node)
+	if err != nil {
+		return fmt.Errorf("daemon: %w", err)
+	}
+
+	go srv.PullEvents()
+	// Do not overwrite the state if we are stopped before rejoining saved
+	// channels.
+	autojoined := make(chan struct{})
+	go func() {
+		node.Run()
+		autojoin(node, cfg.Channels.Autojoin, state, logger.Printf)
+		close(autojoined)
+
+		watchState(cfg.statePath(), node, stateSub, func() string { return "" }, logger.Printf)
+	}()
+
+	logger.Printf("Listening for control connections on %s", *socket)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, unix.SIGTERM, unix.SIGQUIT)
+	<-sig
+
+	logger.Printf("Shutting down...")
+	select {
+	case <-autojoined:
+		if err := saveState(cfg.statePath(), node, ""); err != nil {
+			logger.Printf("Failed to save state file: %v", err)
+		}
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Key management subcommands. None of them start the libp2p node.
+
+func peerIDFromKey(privKey ed25519.PrivateKey) (peer.ID, error) {
+	p2pKey, err := crypto.UnmarshalEd25519PrivateKey(privKey)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPrivateKey(p2pKey)
+}
+
+func keygenCmd(cfg *Config, args []string, getPass passphraseReader) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Overwrite the existing key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(cfg.PrivateKeyPath); err == nil && !*force {
+		return fmt.Errorf("keygen: %s already exists, use -force to overwrite it", cfg.PrivateKeyPath)
+	}
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("keygen: %w", err)
+	}
+	if err := saveKey(cfg.PrivateKeyPath, privKey, cfg.EncryptPrivateKey, getPass); err != nil {
+		return fmt.Errorf("keygen: %w", err)
+	}
+
+	pid, err := peerIDFromKey(privKey)
+	if err != nil {
+		return fmt.Errorf("keygen: %w", err)
+	}
+	fmt.Println(pid)
+	return nil
+}
+
+func idCmd(cfg *Config, args []string, getPass passphraseReader) error {
+	if len(args) != 0 {
+		return errors.New("usage: infchat id")
+	}
+
+	privKey, _, err := readKeyFile(cfg.PrivateKeyPath, getPass)
+	if err != nil {
+		return fmt.Errorf("id: %w", err)
+	}
+	pid, err := peerIDFromKey(privKey)
+	if err != nil {
+		return fmt.Errorf("id: %w", err)
+	}
+	fmt.Println(pid)
+	return nil
+}
+
+func keyCmd(cfg *Config, args []string, getPass passphraseReader) error {
+	if len(args) == 0 {
+		return errors.New("usage: infchat key export|import")
+	}
+
+	switch args[0] {
+	case "export":
+		return keyExportCmd(cfg, args[1:], getPass)
+	case "import":
+		return keyImportCmd(cfg, args[1:], getPass)
+	default:
+		return fmt.Errorf("unknown key subcommand %s, available: export, import", args[0])
+	}
+}
+
+func keyExportCmd(cfg *Config, args []string, getPass passphraseReader) error {
+	fs := flag.NewFlagSet("key export", flag.ContinueOnError)
+	format := fs.String("format", "pem", "Output format: pem (PKCS#8) or libp2p-protobuf")
+	out := fs.String("out", "-", "Output file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	privKey, _, err := readKeyFile(cfg.PrivateKeyPath, getPass)
+	if err != nil {
+		return fmt.Errorf("key export: %w", err)
+	}
+
+	var blob []byte
+	switch *format {
+	case "pem":
+		der, err := x509.MarshalPKCS8PrivateKey(privKey)
+		if err != nil {
+			return fmt.Errorf("key export: %w", err)
+		}
+		blob = pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		})
+	case "libp2p-protobuf":
+		p2pKey, err := crypto.UnmarshalEd25519PrivateKey(privKey)
+		if err != nil {
+			return fmt.Errorf("key export: %w", err)
+		}
+		blob, err = crypto.MarshalPrivateKey(p2pKey)
+		if err != nil {
+			return fmt.Errorf("key export: %w", err)
+		}
+	default:
+		return fmt.Errorf("key export: unknown format %s, available: pem, libp2p-protobuf", *format)
+	}
+
+	if *out == "-" {
+		_, err = os.Stdout.Write(blob)
+	} else {
+		err = ioutil.WriteFile(*out, blob, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("key export: %w", err)
+	}
+	return nil
+}
+
+func keyImportCmd(cfg *Config, args []string, getPass passphraseReader) error {
+	fs := flag.NewFlagSet("key import", flag.ContinueOnError)
+	force := fs.Bool("force", false, "Overwrite the existing key file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: infchat key import [-force] <file>")
+	}
+
+	if _, err := os.Stat(cfg.PrivateKeyPath); err == nil && !*force {
+		return fmt.Errorf("key import: %s already exists, use -force to overwrite it", cfg.PrivateKeyPath)
+	}
+
+	blob, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("key import: %w", err)
+	}
+
+	privKey, err := parseImportedKey(blob)
+	if err != nil {
+		return fmt.Errorf("key import: %w", err)
+	}
+
+	if err := saveKey(cfg.PrivateKeyPath, privKey, cfg.EncryptPrivateKey, getPass); err != nil {
+		return fmt.Errorf("key import: %w", err)
+	}
+
+	pid, err := peerIDFromKey(privKey)
+	if err != nil {
+		return fmt.Errorf("key import: %w", err)
+	}
+	fmt.Println(pid)
+	return nil
+}
+
+// parseImportedKey parses the ed25519 private key in either PEM-encoded
+// PKCS#8 or libp2p protobuf format.
+func parseImportedKey(blob []byte) (ed25519.PrivateKey, error) {
+	if strings.HasPrefix(string(blob), "-----BEGIN") {
+		block, _ := pem.Decode(blob)
+		if block == nil {
+			return nil, errors.New("malformed PEM file")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an ed25519 key")
+		}
+		return edKey, nil
+	}
+
+	p2pKey, err := crypto.UnmarshalPrivateKey(blob)
+	if err != nil {
+		return nil, err
+	}
+	if p2pKey.Type() != crypto.Ed25519 {
+		return nil, errors.New("not an ed25519 key")
+	}
+	raw, err := p2pKey.Raw()
+	if err != nil {
+		return nil, err
+	}
+	// libp2p keeps the public key after the private one, just like
+	// crypto/ed25519 does.
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid private key length")
+	}
+	return ed25519.NewKeyFromSeed(raw[:ed25519.SeedSize]), nil
+}
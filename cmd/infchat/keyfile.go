@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Encrypted key file consists of the header line followed by the
+// base64-encoded scrypt salt, XChaCha20-Poly1305 nonce and the encrypted
+// ed25519 seed. Header is also used as the associated data.
+//
+// Plaintext key files contain just the base64-encoded seed.
+const (
+	encKeyHeader = "infinitychat-encrypted-key-v1"
+
+	scryptN        = 1 << 15
+	scryptR        = 8
+	scryptP        = 1
+	scryptSaltSize = 16
+)
+
+// passphraseReader is used to obtain the key file passphrase. If confirm is
+// true, passphrase is a new one and should be asked twice.
+type passphraseReader func(prompt string, confirm bool) ([]byte, error)
+
+// newPassphraseReader creates the passphraseReader that takes the passphrase
+// from INFCHAT_PASSPHRASE environment variable, the first line of the file
+// descriptor fd (if it is not -1), the first line of the file at path (if it
+// is not empty) or asks the user on the terminal, in this order.
+//
+// The terminal prompt is shown before the UI starts, so it is not usable if
+// infchat runs in background (e.g. daemon or ircd mode started by a service
+// manager), one of the other sources should be used then.
+func newPassphraseReader(fd int, path string) passphraseReader {
+	var fromFD []byte
+	return func(prompt string, confirm bool) ([]byte, error) {
+		if pass := os.Getenv("INFCHAT_PASSPHRASE"); pass != "" {
+			return []byte(pass), nil
+		}
+
+		if fd != -1 {
+			// Can be read only once, so remember it.
+			if fromFD == nil {
+				f := os.NewFile(uintptr(fd), "passphrase-fd")
+				pass, err := readPassphraseLine(f)
+				f.Close()
+				if err != nil {
+					return nil, fmt.Errorf("passphrase: read fd %d: %w", fd, err)
+				}
+				fromFD = pass
+			}
+			return fromFD, nil
+		}
+
+		if path != "" {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, fmt.Errorf("passphrase: %w", err)
+			}
+			defer f.Close()
+			pass, err := readPassphraseLine(f)
+			if err != nil {
+				return nil, fmt.Errorf("passphrase: read %s: %w", path, err)
+			}
+			return pass, nil
+		}
+
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errors.New("passphrase: not a terminal, use INFCHAT_PASSPHRASE, -passphrase-fd or passphrase_file")
+		}
+
+		fmt.Fprint(os.Stderr, prompt)
+		pass, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase: %w", err)
+		}
+		if len(pass) == 0 {
+			return nil, errors.New("passphrase: empty passphrase")
+		}
+		if !confirm {
+			return pass, nil
+		}
+
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase: %w", err)
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, errors.New("passphrase: passphrases do not match")
+		}
+		return pass, nil
+	}
+}
+
+func readPassphraseLine(f *os.File) ([]byte, error) {
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return []byte(line), nil
+}
+
+func isEncryptedKey(blob []byte) bool {
+	return bytes.HasPrefix(blob, []byte(encKeyHeader+"\n"))
+}
+
+func encryptSeed(seed, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, scryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, scryptSaltSize+aead.NonceSize(), scryptSaltSize+aead.NonceSize()+len(seed)+aead.Overhead())
+	copy(blob, salt)
+	nonce := blob[scryptSaltSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	blob = aead.Seal(blob, nonce, seed, []byte(encKeyHeader))
+
+	return []byte(encKeyHeader + "\n" + base64.StdEncoding.EncodeToString(blob) + "\n"), nil
+}
+
+func decryptSeed(file, passphrase []byte) ([]byte, error) {
+	if !isEncryptedKey(file) {
+		return nil, errors.New("not an encrypted key file")
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(file[len(encKeyHeader)+1:])))
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < scryptSaltSize+chacha20poly1305.NonceSizeX {
+		return nil, errors.New("truncated key file")
+	}
+
+	salt := blob[:scryptSaltSize]
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := blob[scryptSaltSize : scryptSaltSize+aead.NonceSize()]
+	seed, err := aead.Open(nil, nonce, blob[scryptSaltSize+aead.NonceSize():], []byte(encKeyHeader))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted key file")
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid private key length")
+	}
+	return seed, nil
+}
+
+// writeKeyFile atomically replaces the key file with the new contents.
+func writeKeyFile(path string, blob []byte) error {
+	if err := ioutil.WriteFile(path+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// encodeKeyFile serializes the private key, encrypting it if passphrase is
+// not nil.
+func encodeKeyFile(privKey ed25519.PrivateKey, passphrase []byte) ([]byte, error) {
+	if passphrase == nil {
+		return []byte(base64.StdEncoding.EncodeToString(privKey.Seed())), nil
+	}
+	return encryptSeed(privKey.Seed(), passphrase)
+}
+
+// readKeyFile reads the private key file, asking for the passphrase if it is
+// encrypted.
+//
+// Error is passed through as is if the key file does not exist, so
+// os.IsNotExist can be used.
+func readKeyFile(path string, getPass passphraseReader) (privKey ed25519.PrivateKey, encrypted bool, err error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if isEncryptedKey(blob) {
+		pass, err := getPass("Private key passphrase: ", false)
+		if err != nil {
+			return nil, true, err
+		}
+		seed, err := decryptSeed(blob, pass)
+		if err != nil {
+			return nil, true, err
+		}
+		return ed25519.NewKeyFromSeed(seed), true, nil
+	}
+
+	seed := make([]byte, ed25519.SeedSize)
+	decodedLen, err := base64.StdEncoding.Decode(seed, bytes.TrimSpace(blob))
+	if err != nil {
+		return nil, false, err
+	}
+	if decodedLen != ed25519.SeedSize {
+		return nil, false, errors.New("invalid private key length")
+	}
+	return ed25519.NewKeyFromSeed(seed), false, nil
+}
+
+// saveKey writes the private key file, encrypting it if encrypt is true.
+func saveKey(path string, privKey ed25519.PrivateKey, encrypt bool, getPass passphraseReader) error {
+	var pass []byte
+	if encrypt {
+		var err error
+		pass, err = getPass("New private key passphrase: ", true)
+		if err != nil {
+			return err
+		}
+	}
+
+	blob, err := encodeKeyFile(privKey, pass)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, blob)
+}
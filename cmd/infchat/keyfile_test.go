@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptSeed(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	file, err := encryptSeed(seed, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedKey(file) {
+		t.Fatal("encrypted key file is not recognized")
+	}
+
+	corrupt := func(f func(blob []byte) []byte) []byte {
+		blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(file[len(encKeyHeader)+1:])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(encKeyHeader + "\n" + base64.StdEncoding.EncodeToString(f(blob)) + "\n")
+	}
+
+	cases := []struct {
+		name       string
+		file       []byte
+		passphrase string
+		fail       bool
+	}{
+		{
+			name:       "correct passphrase",
+			file:       file,
+			passphrase: "correct horse",
+		},
+		{
+			name:       "wrong passphrase",
+			file:       file,
+			passphrase: "battery staple",
+			fail:       true,
+		},
+		{
+			name:       "passphrase prefix",
+			file:       file,
+			passphrase: "correct",
+			fail:       true,
+		},
+		{
+			name:       "empty passphrase",
+			file:       file,
+			passphrase: "",
+			fail:       true,
+		},
+		{
+			name: "changed salt",
+			file: corrupt(func(blob []byte) []byte {
+				blob[0] ^= 1
+				return blob
+			}),
+			passphrase: "correct horse",
+			fail:       true,
+		},
+		{
+			name: "changed ciphertext",
+			file: corrupt(func(blob []byte) []byte {
+				blob[len(blob)-1] ^= 1
+				return blob
+			}),
+			passphrase: "correct horse",
+			fail:       true,
+		},
+		{
+			name: "truncated",
+			file: corrupt(func(blob []byte) []byte {
+				return blob[:scryptSaltSize]
+			}),
+			passphrase: "correct horse",
+			fail:       true,
+		},
+		{
+			name:       "plaintext key file",
+			file:       []byte(base64.StdEncoding.EncodeToString(seed)),
+			passphrase: "correct horse",
+			fail:       true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			got, err := decryptSeed(c.file, []byte(c.passphrase))
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !bytes.Equal(got, seed) {
+				t.Error("decrypted seed does not match")
+			}
+		})
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infchat-keyfile-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constPass := func(pass string) passphraseReader {
+		return func(string, bool) ([]byte, error) { return []byte(pass), nil }
+	}
+
+	encPath := filepath.Join(dir, "encrypted.key")
+	if err := saveKey(encPath, privKey, true, constPass("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	plainPath := filepath.Join(dir, "plain.key")
+	if err := saveKey(plainPath, privKey, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		path      string
+		getPass   passphraseReader
+		encrypted bool
+		fail      bool
+	}{
+		{
+			name:      "encrypted",
+			path:      encPath,
+			getPass:   constPass("passphrase"),
+			encrypted: true,
+		},
+		{
+			name:      "wrong passphrase",
+			path:      encPath,
+			getPass:   constPass("wrong"),
+			encrypted: true,
+			fail:      true,
+		},
+		{
+			name: "passphrase reader error",
+			path: encPath,
+			getPass: func(string, bool) ([]byte, error) {
+				return nil, errors.New("no terminal")
+			},
+			encrypted: true,
+			fail:      true,
+		},
+		{
+			name: "plaintext",
+			path: plainPath,
+			getPass: func(string, bool) ([]byte, error) {
+				t.Error("passphrase requested for the plaintext key")
+				return nil, errors.New("unexpected call")
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			key, encrypted, err := readKeyFile(c.path, c.getPass)
+			if encrypted != c.encrypted {
+				t.Errorf("wrong encrypted flag: want %v, got %v", c.encrypted, encrypted)
+			}
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !bytes.Equal(key, privKey) {
+				t.Error("read key does not match")
+			}
+		})
+	}
+
+	if _, _, err := readKeyFile(filepath.Join(dir, "missing.key"), nil); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestPassphraseReaderFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infchat-passphrase-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	cases := []struct {
+		name string
+		path string
+		env  string
+		want string
+		fail bool
+	}{
+		{
+			name: "first line",
+			path: write("pass", "secret\r\nignored\n"),
+			want: "secret",
+		},
+		{
+			name: "no newline",
+			path: write("pass-nonl", "secret"),
+			want: "secret",
+		},
+		{
+			name: "environment takes precedence",
+			path: write("pass-env", "secret\n"),
+			env:  "from-env",
+			want: "from-env",
+		},
+		{
+			name: "empty",
+			path: write("empty", "\n"),
+			fail: true,
+		},
+		{
+			name: "missing",
+			path: filepath.Join(dir, "missing"),
+			fail: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv("INFCHAT_PASSPHRASE", c.env)
+			defer os.Unsetenv("INFCHAT_PASSPHRASE")
+
+			pass, err := newPassphraseReader(-1, c.path)("Passphrase: ", false)
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if string(pass) != c.want {
+				t.Errorf("wrong passphrase: want %q, got %q", c.want, pass)
+			}
+		})
+	}
+}
@@ -3,15 +3,14 @@ package main
 import (
 	"crypto/ed25519"
 	"crypto/rand"
-	"encoding/base64"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"time"
 
+	"github.com/foxcpp/infinitychat/control"
 	infchat "github.com/foxcpp/infinitychat/node"
 	"github.com/foxcpp/infinitychat/serialui"
 	"github.com/foxcpp/infinitychat/serialui/ircd"
@@ -22,19 +21,22 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func loadKey(ui serialui.UI, path string) (ed25519.PrivateKey, error) {
-	seed := make([]byte, ed25519.SeedSize)
-	privKeyBase64, err := ioutil.ReadFile(path)
+// loadKey reads the private key from the file at path or generates a new one
+// if it does not exist.
+//
+// If encrypt is true, the new key file will be encrypted and the existing
+// plaintext key file will be re-encrypted using the passphrase obtained from
+// getPass.
+func loadKey(ui serialui.UI, path string, encrypt bool, getPass passphraseReader) (ed25519.PrivateKey, error) {
+	privKey, encrypted, err := readKeyFile(path, getPass)
 	if err == nil {
-		decodedLen, err := base64.StdEncoding.Decode(seed, privKeyBase64)
-		if err != nil {
-			return nil, fmt.Errorf("loadKey: %w", err)
-		}
-		if decodedLen != ed25519.SeedSize {
-			return nil, fmt.Errorf("loadKey: invalid private key length")
+		if encrypt && !encrypted {
+			ui.Msg("", "local", "Encrypting the existing private key file...")
+			if err := saveKey(path, privKey, true, getPass); err != nil {
+				return nil, fmt.Errorf("loadKey: %w", err)
+			}
 		}
-
-		return ed25519.NewKeyFromSeed(seed), nil
+		return privKey, nil
 	}
 	if !os.IsNotExist(err) {
 		return nil, fmt.Errorf("loadKey: %w", err)
@@ -42,11 +44,11 @@ func loadKey(ui serialui.UI, path string) (ed25519.PrivateKey, error) {
 
 	ui.Msg("", "local", "Generating a new ed25519 key pair...")
 
-	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	_, privKey, err = ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return nil, fmt.Errorf("loadKey: %w", err)
 	}
-	if err := ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(privKey.Seed())), 0600); err != nil {
+	if err := saveKey(path, privKey, encrypt, getPass); err != nil {
 		return nil, fmt.Errorf("loadKey: %w", err)
 	}
 
@@ -70,6 +72,30 @@ func main() {
 	cfgFile := flag.String("config", "", "Configuration file to use")
 	serialUI := flag.String("serialui", "tview", "Serial UI implementation to use")
 	p2pLog := flag.String("libp2p-log", "warn", "libp2p logger level")
+	passFD := flag.Int("passphrase-fd", -1, "Read private key passphrase from the specified file descriptor")
+	passFile := flag.String("passphrase-file", "", "Read private key passphrase from the specified file, overrides passphrase_file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [subcommand]
+
+Subcommands:
+  chat                 Run the chat client (default)
+  daemon [-socket path]
+                       Run the node without UI, controlled via Unix socket
+  keygen [-force]      Generate a new private key
+  id                   Show the peer ID for the private key
+  key export [-format=pem|libp2p-protobuf] [-out file]
+  key import [-force] <file>
+
+The private key passphrase (see encrypt_private_key) is taken from the first
+of: INFCHAT_PASSPHRASE environment variable, -passphrase-fd, -passphrase-file
+or passphrase_file in the configuration, the terminal. The terminal prompt is
+shown before the UI starts, so daemon and ircd modes running without a
+terminal need one of the other sources.
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	cfg, err := ReadConfig(*cfgFile)
@@ -78,8 +104,61 @@ func main() {
 		return
 	}
 
+	if *passFile != "" {
+		cfg.PassphraseFile = *passFile
+	}
+	getPass := newPassphraseReader(*passFD, cfg.PassphraseFile)
+
+	switch flag.Arg(0) {
+	case "", "chat":
+		runChat(cfg, *serialUI, *p2pLog, getPass)
+		return
+	case "daemon":
+		err = daemonCmd(cfg, flag.Args()[1:], *p2pLog, getPass)
+	case "keygen":
+		err = keygenCmd(cfg, flag.Args()[1:], getPass)
+	case "id":
+		err = idCmd(cfg, flag.Args()[1:], getPass)
+	case "key":
+		err = keyCmd(cfg, flag.Args()[1:], getPass)
+	default:
+		err = fmt.Errorf("unknown subcommand %s, available: chat, daemon, keygen, id, key", flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func nodeConfig(cfg *Config, key ed25519.PrivateKey, logger *log.Logger) infchat.Config {
+	return infchat.Config{
+		Identity:         key,
+		Nickname:         cfg.Nickname,
+		Bootstrap:        cfg.Swarm.Bootstrap,
+		ListenAddrs:      cfg.Swarm.ListenAddrs,
+		StaticRelays:     cfg.Swarm.StaticRelays,
+		ConnsHigh:        cfg.Swarm.HighWaterMark,
+		ConnsLow:         cfg.Swarm.LowWaterMark,
+		PSK:              cfg.Swarm.PSK,
+		MDNSInterval:     time.Duration(cfg.Discovery.MDNSIntervalSecs) * time.Second,
+		RejoinInterval:   time.Duration(cfg.Channels.RejoinIntervalSecs) * time.Second,
+		AnnounceInterval: time.Duration(cfg.Channels.AnnounceIntervalSecs) * time.Second,
+		PresenceInterval: time.Duration(cfg.PresenceIntervalSecs) * time.Second,
+		HistoryDir:       cfg.HistoryDir,
+		ContactsPath:     cfg.contactsPath(),
+		OutboxPath:       cfg.outboxPath(),
+		PeersPath:        cfg.peersPath(),
+		DownloadDir:      cfg.DownloadDir,
+		AttachmentsDir:   cfg.AttachmentsDir,
+		Log:              logger,
+
+		ProvideAttachments: cfg.ProvideAttachments,
+	}
+}
+
+func runChat(cfg *Config, serialUI, p2pLog string, getPass passphraseReader) {
 	var ui RunnableUI
-	switch *serialUI {
+	switch serialUI {
 	case "tview":
 		ui = tui.New()
 	case "simple":
@@ -92,7 +171,7 @@ func main() {
 	}
 
 	if canLog() {
-		level, err := golog.LevelFromString(*p2pLog)
+		level, err := golog.LevelFromString(p2pLog)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
 			return
@@ -100,25 +179,13 @@ func main() {
 		golog.SetAllLoggers(level)
 	}
 
-	key, err := loadKey(ui, cfg.PrivateKeyPath)
+	key, err := loadKey(ui, cfg.PrivateKeyPath, cfg.EncryptPrivateKey, getPass)
 	if err != nil {
 		ui.Error("", "%v", err)
 		return
 	}
 
-	node, err := infchat.NewNode(infchat.Config{
-		Identity:         key,
-		Bootstrap:        cfg.Swarm.Bootstrap,
-		ListenAddrs:      cfg.Swarm.ListenAddrs,
-		StaticRelays:     cfg.Swarm.StaticRelays,
-		ConnsHigh:        cfg.Swarm.HighWaterMark,
-		ConnsLow:         cfg.Swarm.LowWaterMark,
-		PSK:              cfg.Swarm.PSK,
-		MDNSInterval:     time.Duration(cfg.Discovery.MDNSIntervalSecs) * time.Second,
-		RejoinInterval:   time.Duration(cfg.Channels.RejoinIntervalSecs) * time.Second,
-		AnnounceInterval: time.Duration(cfg.Channels.AnnounceIntervalSecs) * time.Second,
-		Log:              log.New(ui, "", 0),
-	})
+	node, err := infchat.NewNode(nodeConfig(cfg, key, log.New(ui, "", 0)))
 	if err != nil {
 		ui.Error("", "%v", err)
 		return
@@ -126,7 +193,17 @@ func main() {
 	defer node.Close()
 
 	go serialui.InputLoop(ui, node)
-	go serialui.PullMessages(ui, node)
+	go serialui.PullEvents(ui, node)
+
+	if cfg.HTTP.Listen != "" {
+		api := control.New(node, log.New(ui, "", 0))
+		if err := api.ListenHTTP(cfg.HTTP.Listen, cfg.HTTP.Token); err != nil {
+			ui.Error("", "%v", err)
+			return
+		}
+		defer api.Close()
+		go api.PullEvents()
+	}
 
 	go func() {
 		sig := make(chan os.Signal, 1)
@@ -136,6 +213,41 @@ func main() {
 		ui.Close()
 	}()
 
-	go node.Run()
+	state, err := readState(cfg.statePath())
+	if err != nil {
+		ui.Error("", "Failed to read state file: %v", err)
+	}
+
+	stateSub, err := subscribeState(node)
+	if err != nil {
+		ui.Error("", "%v", err)
+		return
+	}
+	logf := func(format string, args ...interface{}) {
+		ui.Msg("", "local", format, args...)
+	}
+
+	// Do not overwrite the state if we are stopped before rejoining saved
+	// channels.
+	autojoined := make(chan struct{})
+	go func() {
+		node.Run()
+
+		autojoin(node, cfg.Channels.Autojoin, state, logf)
+		if state.LastBuffer != "" {
+			ui.SetCurrentBuffer(state.LastBuffer)
+		}
+		close(autojoined)
+
+		watchState(cfg.statePath(), node, stateSub, ui.CurrentBuffer, logf)
+	}()
 	ui.Run(node)
+
+	select {
+	case <-autojoined:
+		if err := saveState(cfg.statePath(), node, ui.CurrentBuffer()); err != nil {
+			ui.Error("", "Failed to save state file: %v", err)
+		}
+	default:
+	}
 }
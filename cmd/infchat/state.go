@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	infchat "github.com/foxcpp/infinitychat/node"
+)
+
+// chatState is the client state preserved across restarts.
+//
+// State file contains secrets of joined private channels and so is created
+// readable only by the owner.
+type chatState struct {
+	Channels []string `json:"channels"`
+	// Current buffer name at the time of the shutdown.
+	LastBuffer string `json:"last_buffer,omitempty"`
+}
+
+// readState loads the state file. Missing file is not an error, empty state
+// is returned in this case.
+func readState(path string) (chatState, error) {
+	var state chatState
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(blob, &state); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+// writeState replaces the state file atomically, so it is never left
+// partially written if we crash or lose power in the middle.
+func writeState(path string, state chatState) error {
+	blob, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates the file readable only by the owner.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(blob)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+var stateLock sync.Mutex
+
+// saveState records currently joined channels and the buffer name.
+func saveState(path string, node *infchat.Node, lastBuffer string) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return writeState(path, chatState{
+		Channels:   node.JoinedChannels(),
+		LastBuffer: lastBuffer,
+	})
+}
+
+// subscribeState creates the subscription for watchState. It should be
+// called before autojoin so no changes are missed.
+func subscribeState(node *infchat.Node) (*infchat.Subscription, error) {
+	return node.Subscribe(infchat.EventFilter{
+		Types: []infchat.EventType{infchat.EventJoin},
+		// Only the latest state matters.
+		BufferSize: 1,
+	})
+}
+
+// watchState saves the state each time we join or leave a channel, so it is
+// not lost if we are not stopped cleanly. It returns when the node is
+// closed.
+func watchState(path string, node *infchat.Node, sub *infchat.Subscription, lastBuffer func() string, logf func(string, ...interface{})) {
+	defer sub.Close()
+	for range sub.Events() {
+		if err := saveState(path, node, lastBuffer()); err != nil {
+			logf("Failed to save state file: %v", err)
+		}
+	}
+}
+
+// autojoin joins channels from the configuration and the saved state.
+//
+// Errors are reported using the logf function, failed channels are skipped.
+func autojoin(node *infchat.Node, autojoin []string, state chatState, logf func(string, ...interface{})) {
+	seen := make(map[string]bool)
+
+	join := func(shortForm string) {
+		descr, err := node.ExpandDescriptor(shortForm)
+		if err != nil {
+			logf("Autojoin: invalid descriptor %s: %v", shortForm, err)
+			return
+		}
+		if !strings.HasPrefix(descr, infchat.ChanPrefix) {
+			logf("Autojoin: %s is not a channel", shortForm)
+			return
+		}
+		if seen[descr] {
+			return
+		}
+		seen[descr] = true
+
+		if err := node.JoinChannel(descr); err != nil {
+			logf("Autojoin: %s: %v", infchat.RedactDescriptor(descr), err)
+			return
+		}
+		logf("Joined %s", infchat.RedactDescriptor(node.DescriptorForDisplay(descr)))
+	}
+
+	for _, c := range autojoin {
+		join(c)
+	}
+	for _, c := range state.Channels {
+		join(c)
+	}
+}
@@ -0,0 +1,154 @@
+package control
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// HTTP API endpoints. All requests must carry the bearer token in the
+// Authorization header. Since browsers can't set headers for WebSocket
+// connections, token can also be passed in the "token" query parameter.
+//
+//	GET  /api/status
+//	GET  /api/peers
+//	GET  /api/channels
+//	POST /api/channels/join   {"descriptor": "#chan"}
+//	POST /api/channels/leave  {"descriptor": "#chan"}
+//	POST /api/messages        {"descriptor": "#chan", "text": "hello"}
+//	POST /api/messages/edit   {"descriptor": "#chan", "id": "msg ID", "text": "hello!"}
+//	POST /api/messages/delete {"descriptor": "#chan", "id": "msg ID"}
+//	POST /api/messages/react  {"descriptor": "#chan", "id": "msg ID", "text": "👍"}
+//	GET  /api/events          WebSocket
+//
+// Results are the same as for the corresponding JSON-RPC methods. Errors are
+// reported as {"error": "message"} with the 4xx or 5xx status code.
+//
+// /api/events sends JSON-RPC notifications (one per WebSocket frame) as if
+// the client called subscribe.
+var httpRoutes = map[string]struct {
+	httpMethod string
+	method     string
+}{
+	"/api/status":          {http.MethodGet, "status"},
+	"/api/peers":           {http.MethodGet, "peers"},
+	"/api/channels":        {http.MethodGet, "channels"},
+	"/api/channels/join":   {http.MethodPost, "join"},
+	"/api/channels/leave":  {http.MethodPost, "leave"},
+	"/api/messages":        {http.MethodPost, "post"},
+	"/api/messages/edit":   {http.MethodPost, "edit"},
+	"/api/messages/delete": {http.MethodPost, "delete"},
+	"/api/messages/react":  {http.MethodPost, "react"},
+}
+
+// ListenHTTP starts the HTTP API server on the specified TCP address.
+//
+// Token is required, all requests without it are rejected.
+func (s *Server) ListenHTTP(addr, token string) error {
+	if token == "" {
+		return errors.New("control: http: token is required")
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("control: http: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/events", websocket.Server{
+		// Origin is not checked since the client is authenticated using
+		// the token anyway.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   s.handleEvents,
+	})
+	mux.HandleFunc("/api/", s.handleAPI)
+
+	s.httpSrv = &http.Server{
+		Handler:           authenticate(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          s.Log,
+	}
+	go s.httpSrv.Serve(l)
+	return nil
+}
+
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqToken := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			reqToken = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="infinitychat"`)
+			writeHTTPError(w, http.StatusUnauthorized, "invalid or missing token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	route, ok := httpRoutes[r.URL.Path]
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, "unknown endpoint")
+		return
+	}
+	if r.Method != route.httpMethod {
+		w.Header().Set("Allow", route.httpMethod)
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var params json.RawMessage
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params = body
+	}
+
+	result, err := s.call(nil, route.method, params)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var rpcErr *rpcError
+		if errors.As(err, &rpcErr) && rpcErr.Code == codeInvalidParams {
+			status = http.StatusBadRequest
+		}
+		writeHTTPError(w, status, err.Error())
+		return
+	}
+
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) handleEvents(ws *websocket.Conn) {
+	_, remove := s.addClient(ws, true)
+	defer remove()
+
+	// Nothing is expected from the client, just wait for it to go away.
+	io.Copy(ioutil.Discard, ws)
+}
@@ -0,0 +1,222 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	infchat "github.com/foxcpp/infinitychat/node"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// How long post with wait=true waits for the message to be sent.
+const postWaitTimeout = time.Minute
+
+type descriptorParams struct {
+	Descriptor string `json:"descriptor"`
+}
+
+type postParams struct {
+	Descriptor string `json:"descriptor"`
+	Text       string `json:"text"`
+	Action     bool   `json:"action,omitempty"`
+	// ID of the message this one replies to.
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Wait until the message is sent to peers.
+	Wait bool `json:"wait,omitempty"`
+}
+
+type editParams struct {
+	Descriptor string `json:"descriptor"`
+	ID         string `json:"id"`
+	Text       string `json:"text"`
+	Wait       bool   `json:"wait,omitempty"`
+}
+
+type postResult struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Peers int    `json:"peers,omitempty"`
+}
+
+type peerInfo struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Addrs []string `json:"addrs"`
+}
+
+type statusResult struct {
+	ID             string `json:"id"`
+	Nickname       string `json:"nickname,omitempty"`
+	State          string `json:"state"`
+	ConnectedPeers int    `json:"connected_peers"`
+	KnownPeers     int    `json:"known_peers"`
+	PubsubTopics   int    `json:"pubsub_topics"`
+	NAT            bool   `json:"nat"`
+}
+
+func invalidParams(err error) error {
+	return &rpcError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+func parseParams(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return invalidParams(errors.New("missing params"))
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return invalidParams(err)
+	}
+	return nil
+}
+
+// expand converts the short descriptor form passed by the client into the
+// full one.
+func (s *Server) expand(raw json.RawMessage) (string, error) {
+	var params descriptorParams
+	if err := parseParams(raw, &params); err != nil {
+		return "", err
+	}
+	descr, err := s.Node.ExpandDescriptor(params.Descriptor)
+	if err != nil {
+		return "", invalidParams(err)
+	}
+	return descr, nil
+}
+
+func (s *Server) call(c *client, method string, raw json.RawMessage) (interface{}, error) {
+	switch method {
+	case "join":
+		descr, err := s.expand(raw)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.Node.JoinChannel(descr)
+	case "leave":
+		descr, err := s.expand(raw)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.Node.LeaveChannel(descr)
+	case "post":
+		return s.post(raw)
+	case "edit", "delete", "react":
+		return s.edit(method, raw)
+	case "peers":
+		return s.peers(), nil
+	case "channels":
+		chans := s.Node.JoinedChannels()
+		for i, descr := range chans {
+			chans[i] = s.Node.DescriptorForDisplay(descr)
+		}
+		sort.Strings(chans)
+		return chans, nil
+	case "status":
+		st := s.Node.Status()
+		return statusResult{
+			ID:             s.Node.ID().String(),
+			Nickname:       s.Node.Nickname(s.Node.ID()),
+			State:          st.State,
+			ConnectedPeers: st.ConnectedPeers,
+			KnownPeers:     st.KnownPeers,
+			PubsubTopics:   st.PubsubTopics,
+			NAT:            st.NAT,
+		}, nil
+	case "subscribe":
+		s.clientsLck.Lock()
+		c.subscribed = true
+		s.clientsLck.Unlock()
+		return nil, nil
+	default:
+		return nil, &rpcError{Code: codeMethodNotFound, Message: "unknown method: " + method}
+	}
+}
+
+func (s *Server) post(raw json.RawMessage) (interface{}, error) {
+	var params postParams
+	if err := parseParams(raw, &params); err != nil {
+		return nil, err
+	}
+	if params.Text == "" {
+		return nil, invalidParams(errors.New("empty message"))
+	}
+	descr, err := s.Node.ExpandDescriptor(params.Descriptor)
+	if err != nil {
+		return nil, invalidParams(err)
+	}
+
+	msg := infchat.Message{Kind: infchat.KindText, Text: params.Text, ReplyTo: params.ReplyTo}
+	if params.Action {
+		msg.Kind = infchat.KindAction
+	}
+	d, err := s.Node.PostMessage(descr, msg)
+	if err != nil {
+		return nil, err
+	}
+	return deliveryResult(d, params.Wait)
+}
+
+func (s *Server) edit(method string, raw json.RawMessage) (interface{}, error) {
+	var params editParams
+	if err := parseParams(raw, &params); err != nil {
+		return nil, err
+	}
+	if params.ID == "" {
+		return nil, invalidParams(errors.New("missing message ID"))
+	}
+	if method != "delete" && params.Text == "" {
+		return nil, invalidParams(errors.New("empty message"))
+	}
+	descr, err := s.Node.ExpandDescriptor(params.Descriptor)
+	if err != nil {
+		return nil, invalidParams(err)
+	}
+
+	var d *infchat.Delivery
+	switch method {
+	case "edit":
+		d, err = s.Node.EditMessage(descr, params.ID, params.Text)
+	case "delete":
+		d, err = s.Node.DeleteMessage(descr, params.ID)
+	case "react":
+		d, err = s.Node.React(descr, params.ID, params.Text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deliveryResult(d, params.Wait)
+}
+
+func deliveryResult(d *infchat.Delivery, wait bool) (interface{}, error) {
+	if wait {
+		ctx, cancel := context.WithTimeout(context.Background(), postWaitTimeout)
+		defer cancel()
+		if _, err := d.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	state, peers, _ := d.State()
+	return postResult{ID: d.Message.ID, State: string(state), Peers: peers}, nil
+}
+
+func (s *Server) peers() []peerInfo {
+	conns := s.Node.Host.Network().Peers()
+	res := make([]peerInfo, 0, len(conns))
+	for _, pid := range conns {
+		res = append(res, s.peerInfo(pid))
+	}
+	return res
+}
+
+func (s *Server) peerInfo(pid peer.ID) peerInfo {
+	info := peerInfo{
+		ID:   pid.String(),
+		Name: s.Node.DisplayName(pid),
+	}
+	for _, conn := range s.Node.Host.Network().ConnsToPeer(pid) {
+		info.Addrs = append(info.Addrs, conn.RemoteMultiaddr().String())
+	}
+	return info
+}
@@ -0,0 +1,439 @@
+// Package control implements the local control API for the headless
+// infinitychat node.
+//
+// Control API uses JSON-RPC 2.0 over a stream socket (usually a Unix socket), each
+// message is a single JSON object terminated by a newline. Batch requests
+// are not supported.
+//
+// Methods:
+//
+//	join {"descriptor": "#chan"}
+//	leave {"descriptor": "#chan"}
+//	post {"descriptor": "#chan", "text": "hello", "reply_to": "", "wait": false} -> {"id": "msg ID", "state": "pending"}
+//	edit {"descriptor": "#chan", "id": "msg ID", "text": "hello!"} -> same as post
+//	delete {"descriptor": "#chan", "id": "msg ID"} -> same as post
+//	react {"descriptor": "#chan", "id": "msg ID", "text": "👍"} -> same as post
+//	peers -> [{"id": "Qm...", "name": "nick", "addrs": ["/ip4/..."]}]
+//	channels -> ["#chan", ...]
+//	status -> {"state": "Ready.", ...}
+//	subscribe
+//
+// After the subscribe call the server starts sending notifications for node
+// events: "message" (Message object as params), "channel_peer",
+// "connection", "reachability" and "delivery". Edits, deletions and
+// reactions are "message" notifications with kind "edit", "delete" or
+// "reaction" and target set to the ID of the changed message.
+//
+// The same methods are also available as an HTTP API, see ListenHTTP.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	infchat "github.com/foxcpp/infinitychat/node"
+	"github.com/libp2p/go-libp2p-core/network"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Maximum size of a single request.
+	maxRequestSize = 1024 * 1024
+
+	// Amount of notifications queued for a slow client before we start
+	// dropping them.
+	notifyQueueSize = 128
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+)
+
+type request struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type notification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// Message is the JSON representation of infchat.Message used in
+// notifications.
+type Message struct {
+	ID         string            `json:"id"`
+	Sender     string            `json:"sender"`
+	SenderName string            `json:"sender_name"`
+	Channel    string            `json:"channel"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Kind       string            `json:"kind"`
+	Text       string            `json:"text"`
+	ReplyTo    string            `json:"reply_to,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Extensions map[string]string `json:"ext,omitempty"`
+	RelayedBy  string            `json:"relayed_by,omitempty"`
+	Unverified bool              `json:"unverified,omitempty"`
+}
+
+func NewMessage(node *infchat.Node, msg infchat.Message) Message {
+	m := Message{
+		ID:         msg.ID,
+		Sender:     msg.Sender.String(),
+		SenderName: node.DisplayName(msg.Sender),
+		Channel:    node.DescriptorForDisplay(msg.Channel),
+		Timestamp:  msg.Timestamp,
+		Kind:       string(msg.Kind),
+		Text:       msg.Text,
+		ReplyTo:    msg.ReplyTo,
+		Target:     msg.Target,
+		Extensions: msg.Extensions,
+	}
+	if msg.RelayedBy != "" {
+		m.RelayedBy = msg.RelayedBy.String()
+		m.Unverified = msg.Unverified
+	}
+	return m
+}
+
+type channelPeerEvent struct {
+	Channel string `json:"channel"`
+	Peer    string `json:"peer"`
+	Name    string `json:"name"`
+	Joined  bool   `json:"joined"`
+}
+
+type connectionEvent struct {
+	Peer      string `json:"peer"`
+	Addr      string `json:"addr"`
+	Connected bool   `json:"connected"`
+}
+
+type deliveryEvent struct {
+	Channel   string `json:"channel"`
+	MessageID string `json:"id"`
+	State     string `json:"state"`
+	Peers     int    `json:"peers,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type reachabilityEvent struct {
+	Reachability string `json:"reachability"`
+}
+
+func reachabilityString(r network.Reachability) string {
+	switch r {
+	case network.ReachabilityPublic:
+		return "public"
+	case network.ReachabilityPrivate:
+		return "private"
+	default:
+		return "unknown"
+	}
+}
+
+type client struct {
+	conn net.Conn
+
+	writeLock sync.Mutex
+	enc       *json.Encoder
+
+	subscribed bool
+	notify     chan notification
+}
+
+func (c *client) send(v interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	return c.enc.Encode(v)
+}
+
+type Server struct {
+	Node *infchat.Node
+	Log  *log.Logger
+
+	l       net.Listener
+	httpSrv *http.Server
+
+	clientsLck sync.Mutex
+	clients    map[*client]struct{}
+}
+
+func New(node *infchat.Node, logger *log.Logger) *Server {
+	return &Server{
+		Node:    node,
+		Log:     logger,
+		clients: map[*client]struct{}{},
+	}
+}
+
+// ListenUnix creates the Unix socket at path, accessible only by the current
+// user, and starts serving connections on it.
+//
+// Stale socket left by the previous instance is replaced. It is an error if
+// path exists and is not a socket or another instance is still listening on
+// it.
+func (s *Server) ListenUnix(path string) error {
+	if err := removeStaleSocket(path); err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+
+	// Socket should not be accessible by anybody else even for a moment, so
+	// set permissions on creation instead of changing them later.
+	oldMask := unix.Umask(0077)
+	l, err := net.Listen("unix", path)
+	unix.Umask(oldMask)
+	if err != nil {
+		return fmt.Errorf("control: %w", err)
+	}
+
+	go s.Serve(l)
+	return nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use, is another instance running?", path)
+	}
+
+	return os.Remove(path)
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l net.Listener) {
+	s.l = l
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	if s.l != nil {
+		s.l.Close()
+	}
+	if s.httpSrv != nil {
+		s.httpSrv.Close()
+	}
+
+	s.clientsLck.Lock()
+	defer s.clientsLck.Unlock()
+	for c := range s.clients {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// PullEvents distributes events generated by the node to subscribed clients.
+// It returns when node is closed.
+func (s *Server) PullEvents() {
+	sub, err := s.Node.Subscribe(infchat.EventFilter{})
+	if err != nil {
+		s.Log.Printf("control: %v", err)
+		return
+	}
+	defer sub.Close()
+
+	for ev := range sub.Events() {
+		switch ev := ev.(type) {
+		case infchat.MessageEvent:
+			s.Broadcast("message", NewMessage(s.Node, ev.Message))
+		case infchat.ChannelPeerEvent:
+			s.Broadcast("channel_peer", channelPeerEvent{
+				Channel: s.Node.DescriptorForDisplay(ev.Channel),
+				Peer:    ev.Peer.String(),
+				Name:    s.Node.DisplayName(ev.Peer),
+				Joined:  ev.Joined,
+			})
+		case infchat.ConnectionEvent:
+			s.Broadcast("connection", connectionEvent{
+				Peer:      ev.Peer.String(),
+				Addr:      ev.Addr.String(),
+				Connected: ev.Connected,
+			})
+		case infchat.DeliveryEvent:
+			de := deliveryEvent{
+				Channel:   s.Node.DescriptorForDisplay(ev.Channel),
+				MessageID: ev.MessageID,
+				State:     string(ev.State),
+				Peers:     ev.Peers,
+			}
+			if ev.Err != nil {
+				de.Error = ev.Err.Error()
+			}
+			s.Broadcast("delivery", de)
+		case infchat.ReachabilityEvent:
+			s.Broadcast("reachability", reachabilityEvent{
+				Reachability: reachabilityString(ev.Reachability),
+			})
+		}
+	}
+}
+
+// Broadcast sends the notification to all subscribed clients.
+//
+// Notifications are dropped for clients that do not keep up.
+func (s *Server) Broadcast(method string, params interface{}) {
+	s.clientsLck.Lock()
+	defer s.clientsLck.Unlock()
+
+	for c := range s.clients {
+		if !c.subscribed {
+			continue
+		}
+		select {
+		case c.notify <- notification{Version: "2.0", Method: method, Params: params}:
+		default:
+			s.Log.Printf("control: client %v is too slow, dropping notification", c.conn.RemoteAddr())
+		}
+	}
+}
+
+// addClient registers the connection and starts the goroutine sending
+// notifications to it. Returned function should be called once the
+// connection is closed.
+func (s *Server) addClient(conn net.Conn, subscribed bool) (*client, func()) {
+	c := &client{
+		conn:       conn,
+		enc:        json.NewEncoder(conn),
+		subscribed: subscribed,
+		notify:     make(chan notification, notifyQueueSize),
+	}
+
+	s.clientsLck.Lock()
+	s.clients[c] = struct{}{}
+	s.clientsLck.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case n := <-c.notify:
+				if err := c.send(n); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return c, func() {
+		s.clientsLck.Lock()
+		delete(s.clients, c)
+		s.clientsLck.Unlock()
+		close(done)
+		conn.Close()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	c, remove := s.addClient(conn, false)
+	defer remove()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxRequestSize)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			c.send(response{
+				Version: "2.0",
+				ID:      json.RawMessage("null"),
+				Error:   &rpcError{Code: codeParseError, Message: err.Error()},
+			})
+			continue
+		}
+		if req.Version != "2.0" || req.Method == "" {
+			c.send(response{
+				Version: "2.0",
+				ID:      nullIfEmpty(req.ID),
+				Error:   &rpcError{Code: codeInvalidRequest, Message: "invalid request"},
+			})
+			continue
+		}
+
+		result, err := s.call(c, req.Method, req.Params)
+
+		// Request without ID is a notification, no response expected.
+		if len(req.ID) == 0 {
+			continue
+		}
+
+		resp := response{Version: "2.0", ID: req.ID}
+		if err != nil {
+			var rpcErr *rpcError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = &rpcError{Code: codeInternalError, Message: err.Error()}
+			}
+			resp.Error = rpcErr
+		} else {
+			if result == nil {
+				result = true
+			}
+			resp.Result = result
+		}
+		if err := c.send(resp); err != nil {
+			return
+		}
+	}
+}
+
+func nullIfEmpty(id json.RawMessage) json.RawMessage {
+	if len(id) == 0 {
+		return json.RawMessage("null")
+	}
+	return id
+}
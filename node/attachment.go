@@ -0,0 +1,336 @@
+package infchat
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/multiformats/go-multihash"
+)
+
+// BlobProtocol is the stream protocol used to fetch message attachments.
+//
+// It uses the same framing as FileProtocol. Unlike file offers, attachments
+// are content-addressed and are not bound to the channel: any node that has
+// the blob in its attachment store (the sender and everybody who fetched
+// it) serves it to anybody who knows its hash.
+//
+// Attachments of public channel messages are also announced in the DHT if
+// Cfg.ProvideAttachments is set so they can be fetched after the sender goes
+// offline. Attachments of private channels and direct messages are never
+// announced since that would leak their hashes.
+const BlobProtocol protocol.ID = "/infinitychat/v0.1/blob"
+
+// Maximum amount of DHT providers to try when fetching the attachment.
+const maxBlobProviders = 10
+
+var (
+	ErrNoAttachmentsDir  = errors.New("attachments directory is not configured")
+	ErrUnknownAttachment = errors.New("message has no such attachment")
+)
+
+// blobDir returns the directory the blob is stored in. The blob itself is
+// saved there under the name it was first added or fetched with.
+func (n *Node) blobDir(hash string) string {
+	return filepath.Join(n.Cfg.AttachmentsDir, hash)
+}
+
+// blobPath returns the path of the stored blob with the specified hash, if
+// there is one.
+func (n *Node) blobPath(hash string) (string, bool) {
+	if n.Cfg.AttachmentsDir == "" {
+		return "", false
+	}
+	if err := checkFileInfo(FileInfo{Name: "blob", Hash: hash}); err != nil {
+		return "", false
+	}
+
+	entries, err := ioutil.ReadDir(n.blobDir(hash))
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			return filepath.Join(n.blobDir(hash), e.Name()), true
+		}
+	}
+	return "", false
+}
+
+// lockBlob serializes operations on the blob with the specified hash in the
+// attachment store so they don't write to the same partial file. The
+// returned function releases the lock.
+func (n *Node) lockBlob(ctx context.Context, hash string) (func(), error) {
+	for {
+		n.filesLock.Lock()
+		busy, ok := n.blobsBusy[hash]
+		if !ok {
+			busy = make(chan struct{})
+			n.blobsBusy[hash] = busy
+			n.filesLock.Unlock()
+			return func() {
+				n.filesLock.Lock()
+				delete(n.blobsBusy, hash)
+				n.filesLock.Unlock()
+				close(busy)
+			}, nil
+		}
+		n.filesLock.Unlock()
+
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AddAttachment copies the file into the attachment store and returns its
+// description to be put into Message.Attachments.
+func (n *Node) AddAttachment(path string) (FileInfo, error) {
+	if n.Cfg.AttachmentsDir == "" {
+		return FileInfo{}, ErrNoAttachmentsDir
+	}
+	info, err := hashFile(path)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	if err := checkFileInfo(info); err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	unlock, err := n.lockBlob(n.nodeContext, info.Hash)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	defer unlock()
+	if _, ok := n.blobPath(info.Hash); ok {
+		return info, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(n.blobDir(info.Hash), 0700); err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	partPath := filepath.Join(n.blobDir(info.Hash), ".part")
+	dst, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(partPath)
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(partPath)
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	if err := os.Rename(partPath, filepath.Join(n.blobDir(info.Hash), info.Name)); err != nil {
+		return FileInfo{}, fmt.Errorf("attach: %w", err)
+	}
+	return info, nil
+}
+
+// PostAttachment adds the file to the attachment store and sends the text
+// message with the file attached to the channel or peer referenced by the
+// descriptor. Text defaults to the file name.
+func (n *Node) PostAttachment(descr, path, text string) (*Delivery, error) {
+	info, err := n.AddAttachment(path)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		text = info.Name
+	}
+	return n.PostMessage(descr, Message{
+		Kind:        KindText,
+		Text:        text,
+		Attachments: []FileInfo{info},
+	})
+}
+
+func (n *Node) handleBlobStream(s network.Stream) {
+	n.serveTransfer(s, func(req fileRequest, remote peer.ID) (string, int64, error) {
+		path, ok := n.blobPath(req.Hash)
+		if !ok {
+			return "", 0, errors.New("no such blob")
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return "", 0, errors.New("no such blob")
+		}
+		return path, st.Size(), nil
+	})
+}
+
+func blobCid(hash string) (cid.Cid, error) {
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
+		return cid.Undef, err
+	}
+	mh, err := multihash.Encode(digest, multihash.SHA2_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(cid.Raw, mh), nil
+}
+
+// shouldProvide reports whether attachments of messages in the channel can
+// be announced in the DHT.
+func (n *Node) shouldProvide(descr string) bool {
+	return n.Cfg.ProvideAttachments && strings.HasPrefix(descr, ChanPrefix) && !IsPrivateChannel(descr)
+}
+
+// provideBlobs announces that we have the blobs in the DHT.
+func (n *Node) provideBlobs(infos []FileInfo) {
+	for _, info := range infos {
+		if _, ok := n.blobPath(info.Hash); !ok {
+			continue
+		}
+		c, err := blobCid(info.Hash)
+		if err != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(n.nodeContext, time.Minute)
+		err = n.kdht.Provide(ctx, c, true)
+		cancel()
+		if err != nil {
+			n.Cfg.Log.Printf("Failed to provide attachment %s: %v", info.Hash, err)
+		}
+	}
+}
+
+// Attachments returns the attachments of the message and its sender.
+func (n *Node) Attachments(descr, msgID string) ([]FileInfo, peer.ID, error) {
+	if rm, ok := n.recent.get(msgID); ok && rm.Channel == descr {
+		return rm.Attachments, rm.Sender, nil
+	}
+	if n.history == nil {
+		return nil, "", ErrUnknownMessage
+	}
+
+	msgs, err := n.history.Query(descr, HistoryQuery{})
+	if err != nil {
+		return nil, "", err
+	}
+	for _, msg := range msgs {
+		if msg.ID == msgID {
+			return msg.Attachments, msg.Sender, nil
+		}
+	}
+	return nil, "", ErrUnknownMessage
+}
+
+// FetchAttachment downloads the attachment of the message with the
+// specified hash into the attachment store and returns its path. Blobs
+// already in the store are not downloaded again, concurrent fetches of the
+// same blob wait for the first one to complete.
+//
+// The blob is requested from the message sender first, then from other
+// connected channel members and then from providers found in the DHT, for
+// public channels. Fetched blobs are served to other peers and are announced
+// in the DHT if Cfg.ProvideAttachments is set.
+//
+// progress, if not nil, is called periodically with the amount of bytes
+// downloaded so far.
+func (n *Node) FetchAttachment(ctx context.Context, descr, msgID, hash string, progress func(done, total int64)) (string, error) {
+	if n.Cfg.AttachmentsDir == "" {
+		return "", ErrNoAttachmentsDir
+	}
+	infos, sender, err := n.Attachments(descr, msgID)
+	if err != nil {
+		return "", err
+	}
+	var info *FileInfo
+	for i := range infos {
+		if infos[i].Hash == hash {
+			info = &infos[i]
+			break
+		}
+	}
+	if info == nil {
+		return "", ErrUnknownAttachment
+	}
+	if err := checkFileInfo(*info); err != nil {
+		return "", err
+	}
+
+	unlock, err := n.lockBlob(ctx, info.Hash)
+	if err != nil {
+		return "", fmt.Errorf("fetch: %w", err)
+	}
+	defer unlock()
+	if path, ok := n.blobPath(info.Hash); ok {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(n.blobDir(info.Hash), 0700); err != nil {
+		return "", fmt.Errorf("fetch: %w", err)
+	}
+	partPath := filepath.Join(n.blobDir(info.Hash), ".part")
+
+	sources := []peer.ID{sender}
+	if strings.HasPrefix(descr, ChanPrefix) {
+		for _, pid := range n.ConnectedMembers(descr) {
+			if pid != sender {
+				sources = append(sources, pid)
+			}
+		}
+	}
+	err = n.download(ctx, BlobProtocol, sources, *info, partPath, progress)
+	if err != nil && ctx.Err() == nil && strings.HasPrefix(descr, ChanPrefix) && !IsPrivateChannel(descr) {
+		n.Cfg.Log.Printf("Looking up providers of %s in DHT", info.Hash)
+		err = n.download(ctx, BlobProtocol, n.findBlobProviders(ctx, info.Hash), *info, partPath, progress)
+	}
+	if err != nil {
+		return "", fmt.Errorf("fetch: %w", err)
+	}
+
+	path := filepath.Join(n.blobDir(info.Hash), info.Name)
+	if err := os.Rename(partPath, path); err != nil {
+		return "", fmt.Errorf("fetch: %w", err)
+	}
+
+	if n.shouldProvide(descr) {
+		go n.provideBlobs([]FileInfo{*info})
+	}
+	return path, nil
+}
+
+func (n *Node) findBlobProviders(ctx context.Context, hash string) []peer.ID {
+	c, err := blobCid(hash)
+	if err != nil {
+		return nil
+	}
+
+	findCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var pids []peer.ID
+	for pi := range n.kdht.FindProvidersAsync(findCtx, c, maxBlobProviders) {
+		if pi.ID == n.ID() {
+			continue
+		}
+		n.Host.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.TempAddrTTL)
+		pids = append(pids, pi.ID)
+	}
+	return pids
+}
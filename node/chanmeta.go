@@ -0,0 +1,455 @@
+package infchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// ChannelMetaProtocol is the request-response protocol used by new channel
+// members to fetch the current channel metadata record.
+//
+// Requester sends a single JSON-encoded metaRequest, responder replies with
+// the JSON-encoded channelMetaRecord, if it has one, and closes the stream.
+//
+// Changes are published to the channel as KindTopic messages carrying the
+// record. Records are signed by the member that made the change, so they
+// can be relayed by anybody. Channels have no owners, any member can change
+// the metadata.
+const ChannelMetaProtocol protocol.ID = "/infinitychat/v0.1/chanmeta"
+
+const (
+	MaxTopicLen       = 390
+	MaxDescriptionLen = 1024
+
+	// How many channel members to ask for the metadata on join.
+	metaSyncPeers = 3
+
+	// Margin for clock differences when checking record times.
+	metaClockSkew = 5 * time.Minute
+
+	// How many changes a record can be ahead of the one it replaces, in
+	// addition to one per second between their update times. It keeps a
+	// member from publishing a version nobody can follow.
+	metaVersionBurst = 100
+)
+
+// ChannelMeta is the channel metadata shown to members.
+type ChannelMeta struct {
+	Topic       string
+	Description string
+
+	// Peer that set the metadata first and when it happened. It is
+	// informational only: nothing prevents a member from claiming it
+	// created the channel earlier.
+	Creator peer.ID
+	Created time.Time
+
+	// Peer that made the last change and when it happened, as claimed by
+	// that peer.
+	Author  peer.ID
+	Updated time.Time
+
+	// Incremented on each change.
+	Version uint64
+}
+
+// ChannelMetaEvent is generated when the newer metadata record is received
+// for the joined channel or we change it ourselves.
+type ChannelMetaEvent struct {
+	Channel string
+	Meta    ChannelMeta
+}
+
+func (ChannelMetaEvent) Type() EventType { return EventChannelMeta }
+
+// channelMetaRecord is the signed wire representation of ChannelMeta.
+type channelMetaRecord struct {
+	// Pubsub topic name, not the descriptor, so the record does not contain
+	// private channel keys but still can not be replayed in another channel.
+	Channel     string `json:"channel"`
+	Topic       string `json:"topic"`
+	Description string `json:"description,omitempty"`
+
+	// Unix time in milliseconds.
+	Created int64  `json:"created"`
+	Creator string `json:"creator"`
+	// Signature of the creator over creatorData, carried over by later
+	// versions of the record.
+	CreatorSig []byte `json:"creator_sig"`
+
+	Version uint64 `json:"version"`
+	// Unix time in milliseconds.
+	Updated   int64  `json:"updated"`
+	Author    string `json:"author"`
+	Signature []byte `json:"sig"`
+}
+
+// knownMeta is the verified record and its contents.
+type knownMeta struct {
+	rec  channelMetaRecord
+	meta ChannelMeta
+}
+
+type metaRequest struct {
+	Topic string `json:"topic"`
+}
+
+func (r channelMetaRecord) creatorData() []byte {
+	return []byte("infinitychat-channel-creator\n" + r.Channel + "\n" +
+		strconv.FormatInt(r.Created, 10))
+}
+
+func (r channelMetaRecord) signedData() []byte {
+	// Description is the only field that can contain line breaks, so it
+	// goes last.
+	return []byte("infinitychat-channel-meta\n" + r.Channel + "\n" +
+		strconv.FormatUint(r.Version, 10) + "\n" +
+		strconv.FormatInt(r.Updated, 10) + "\n" + r.Author + "\n" +
+		r.Creator + "\n" + strconv.FormatInt(r.Created, 10) + "\n" +
+		r.Topic + "\n" + r.Description)
+}
+
+func verifySignature(pidStr string, data, sig []byte) (peer.ID, error) {
+	pid, err := peer.Decode(pidStr)
+	if err != nil {
+		return "", err
+	}
+	pubKey, err := pid.ExtractPublicKey()
+	if err != nil {
+		return "", err
+	}
+	ok, err := pubKey.Verify(data, sig)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("signature verification failed")
+	}
+	return pid, nil
+}
+
+// versionLimit returns the highest version of the record updated at the
+// time if the record with the base version was updated at baseTime. Times
+// are Unix time in milliseconds.
+func versionLimit(base uint64, baseTime, updated int64) uint64 {
+	limit := base + metaVersionBurst
+	if updated > baseTime {
+		limit += uint64(updated-baseTime) / 1000
+	}
+	return limit
+}
+
+// CheckTopic checks whether the strings can be used as the channel topic
+// and description.
+func CheckTopic(topic, description string) error {
+	if len(topic) > MaxTopicLen {
+		return errors.New("topic is too long")
+	}
+	if strings.ContainsAny(topic, "\r\n") {
+		return errors.New("topic can not contain line breaks")
+	}
+	if len(description) > MaxDescriptionLen {
+		return errors.New("description is too long")
+	}
+	return nil
+}
+
+// verify checks the record signatures and contents and converts it into
+// ChannelMeta.
+func (r channelMetaRecord) verify(descr string) (ChannelMeta, error) {
+	if r.Channel != TopicName(descr) {
+		return ChannelMeta{}, errors.New("channel meta: record is for another channel")
+	}
+	if err := CheckTopic(r.Topic, r.Description); err != nil {
+		return ChannelMeta{}, fmt.Errorf("channel meta: %w", err)
+	}
+	if r.Created < 0 {
+		return ChannelMeta{}, errors.New("channel meta: invalid creation time")
+	}
+	latest := time.Now().Add(metaClockSkew)
+	if time.Unix(0, r.Created*int64(time.Millisecond)).After(latest) {
+		return ChannelMeta{}, errors.New("channel meta: creation time is in the future")
+	}
+	if time.Unix(0, r.Updated*int64(time.Millisecond)).After(latest) {
+		return ChannelMeta{}, errors.New("channel meta: update time is in the future")
+	}
+	// Since both times are bounded, so is the version and it can not
+	// overflow when incremented.
+	if r.Version > versionLimit(0, r.Created, r.Updated) {
+		return ChannelMeta{}, errors.New("channel meta: version is too high for the channel age")
+	}
+	creator, err := verifySignature(r.Creator, r.creatorData(), r.CreatorSig)
+	if err != nil {
+		return ChannelMeta{}, fmt.Errorf("channel meta: creator: %w", err)
+	}
+	author, err := verifySignature(r.Author, r.signedData(), r.Signature)
+	if err != nil {
+		return ChannelMeta{}, fmt.Errorf("channel meta: %w", err)
+	}
+	return ChannelMeta{
+		Topic:       r.Topic,
+		Description: r.Description,
+		Creator:     creator,
+		Created:     time.Unix(0, r.Created*int64(time.Millisecond)),
+		Author:      author,
+		Updated:     time.Unix(0, r.Updated*int64(time.Millisecond)),
+		Version:     r.Version,
+	}, nil
+}
+
+// newerThan reports whether the record should replace old.
+//
+// If two members independently created the metadata, the earlier creation
+// claim wins and records carrying the other one are ignored. Otherwise, the
+// higher version wins and concurrent changes are ordered by time and
+// author.
+func (r channelMetaRecord) newerThan(old channelMetaRecord) bool {
+	if r.Creator != old.Creator || r.Created != old.Created {
+		if r.Created != old.Created {
+			return r.Created < old.Created
+		}
+		return r.Creator < old.Creator
+	}
+	if r.Version != old.Version {
+		return r.Version > old.Version
+	}
+	if r.Updated != old.Updated {
+		return r.Updated > old.Updated
+	}
+	return r.Author > old.Author
+}
+
+// applyChannelMeta verifies the record and saves it if it is newer than the
+// one we have. ChannelMetaEvent is generated if it is.
+func (n *Node) applyChannelMeta(descr string, rec channelMetaRecord) error {
+	meta, err := rec.verify(descr)
+	if err != nil {
+		return err
+	}
+
+	n.metaLock.Lock()
+	if old, ok := n.channelMeta[descr]; ok {
+		if !rec.newerThan(old.rec) {
+			n.metaLock.Unlock()
+			return nil
+		}
+		if rec.Version > versionLimit(old.rec.Version, old.rec.Updated, rec.Updated) {
+			n.metaLock.Unlock()
+			return errors.New("channel meta: version jumps too far ahead")
+		}
+	}
+	n.channelMeta[descr] = knownMeta{rec: rec, meta: meta}
+	n.metaLock.Unlock()
+
+	n.events.publish(ChannelMetaEvent{Channel: descr, Meta: meta})
+	return nil
+}
+
+func (n *Node) channelMetaRecord(descr string) (channelMetaRecord, bool) {
+	n.metaLock.Lock()
+	defer n.metaLock.Unlock()
+	known, ok := n.channelMeta[descr]
+	return known.rec, ok
+}
+
+// ChannelMeta returns the channel metadata. False is returned if nobody set
+// it or we did not receive it yet.
+func (n *Node) ChannelMeta(descr string) (ChannelMeta, bool) {
+	n.metaLock.Lock()
+	defer n.metaLock.Unlock()
+	known, ok := n.channelMeta[descr]
+	return known.meta, ok
+}
+
+// SetChannelMeta changes the channel topic and description and publishes the
+// signed record to the channel as a KindTopic message.
+func (n *Node) SetChannelMeta(descr, topic, description string) (*Delivery, error) {
+	if !strings.HasPrefix(descr, ChanPrefix) {
+		return nil, errors.New("channel meta: not a channel")
+	}
+	if err := CheckTopic(topic, description); err != nil {
+		return nil, fmt.Errorf("channel meta: %w", err)
+	}
+	privKey := n.Host.Peerstore().PrivKey(n.ID())
+	if privKey == nil {
+		return nil, errors.New("channel meta: no private key")
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	rec := channelMetaRecord{
+		Channel:     TopicName(descr),
+		Topic:       topic,
+		Description: description,
+		Version:     1,
+		Updated:     now,
+		Author:      peer.Encode(n.ID()),
+	}
+	if old, ok := n.channelMetaRecord(descr); ok {
+		rec.Creator = old.Creator
+		rec.Created = old.Created
+		rec.CreatorSig = old.CreatorSig
+		if old.Version == math.MaxUint64 {
+			return nil, errors.New("channel meta: version limit reached")
+		}
+		rec.Version = old.Version + 1
+	} else {
+		rec.Creator = rec.Author
+		rec.Created = now
+
+		var err error
+		rec.CreatorSig, err = privKey.Sign(rec.creatorData())
+		if err != nil {
+			return nil, fmt.Errorf("channel meta: %w", err)
+		}
+	}
+
+	var err error
+	rec.Signature, err = privKey.Sign(rec.signedData())
+	if err != nil {
+		return nil, fmt.Errorf("channel meta: %w", err)
+	}
+
+	d, err := n.PostMessage(descr, Message{
+		Kind: KindTopic,
+		Text: topic,
+		meta: &rec,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := n.applyChannelMeta(descr, rec); err != nil {
+		n.Cfg.Log.Printf("Failed to apply own channel meta: %v", err)
+	}
+	return d, nil
+}
+
+// loadChannelMeta restores the metadata record from KindTopic messages in
+// the local history.
+func (n *Node) loadChannelMeta(descr string) {
+	if n.history == nil {
+		return
+	}
+	msgs, err := n.history.Query(descr, HistoryQuery{})
+	if err != nil {
+		n.Cfg.Log.Printf("Failed to load channel meta: %v", err)
+		return
+	}
+	for _, msg := range msgs {
+		if msg.Kind == KindTopic && msg.meta != nil {
+			n.applyChannelMeta(descr, *msg.meta)
+		}
+	}
+}
+
+func (n *Node) handleChannelMetaStream(s network.Stream) {
+	defer s.Close()
+
+	remote := s.Conn().RemotePeer()
+
+	s.SetReadDeadline(time.Now().Add(15 * time.Second))
+	var req metaRequest
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+
+	descr, ok := n.joinedByTopic(req.Topic)
+	if !ok {
+		return
+	}
+	isMember := false
+	for _, p := range n.PubsubProto.ListPeers(req.Topic) {
+		if p == remote {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		n.Cfg.Log.Printf("Channel meta request from %v for %s refused: not a member", remote, RedactDescriptor(descr))
+		return
+	}
+
+	rec, ok := n.channelMetaRecord(descr)
+	if !ok {
+		return
+	}
+	s.SetWriteDeadline(time.Now().Add(15 * time.Second))
+	if err := json.NewEncoder(s).Encode(rec); err != nil {
+		s.Reset()
+		return
+	}
+}
+
+func (n *Node) requestChannelMeta(ctx context.Context, pid peer.ID, descr string) error {
+	s, err := n.Host.NewStream(ctx, pid, ChannelMetaProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.SetDeadline(time.Now().Add(15 * time.Second))
+	if err := json.NewEncoder(s).Encode(metaRequest{Topic: TopicName(descr)}); err != nil {
+		s.Reset()
+		return err
+	}
+
+	var rec channelMetaRecord
+	if err := json.NewDecoder(io.LimitReader(s, 4*MaxDescriptionLen)).Decode(&rec); err != nil {
+		if err == io.EOF {
+			// Peer does not have the record.
+			return nil
+		}
+		s.Reset()
+		return err
+	}
+	return n.applyChannelMeta(descr, rec)
+}
+
+// syncChannelMetaOnJoin loads the metadata record from the local history,
+// waits for the channel members to appear and asks them for the newer one.
+func (n *Node) syncChannelMetaOnJoin(descr string) {
+	n.loadChannelMeta(descr)
+
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	deadline := time.Now().Add(time.Minute)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-t.C:
+		case <-n.nodeContext.Done():
+			return
+		}
+
+		if !n.IsJoined(descr) {
+			return
+		}
+		members := n.ConnectedMembers(descr)
+		if len(members) == 0 {
+			continue
+		}
+		if len(members) > metaSyncPeers {
+			members = members[:metaSyncPeers]
+		}
+
+		ctx, cancel := context.WithTimeout(n.nodeContext, 30*time.Second)
+		for _, p := range members {
+			if err := n.requestChannelMeta(ctx, p, descr); err != nil {
+				n.Cfg.Log.Printf("Channel meta request to %v failed: %v", p, err)
+			}
+		}
+		cancel()
+		return
+	}
+}
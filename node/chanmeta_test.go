@@ -0,0 +1,73 @@
+package infchat
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+func TestChannelMetaVerify(t *testing.T) {
+	const descr = ChanPrefix + "test"
+
+	key, pid := testPeer(t)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	hour := int64(time.Hour / time.Millisecond)
+
+	cases := []struct {
+		name    string
+		created int64
+		updated int64
+		version uint64
+		fail    bool
+	}{
+		{name: "new", created: now, updated: now, version: 1},
+		{name: "many changes", created: now - hour, updated: now, version: 3000},
+		{name: "backdated", created: 0, updated: now, version: 1},
+		{name: "negative creation time", created: -hour, updated: now, version: 1, fail: true},
+		{name: "future creation time", created: now + hour, updated: now + hour, version: 1, fail: true},
+		{name: "future update time", created: now, updated: now + hour, version: 2, fail: true},
+		{name: "too many changes", created: now - hour, updated: now, version: 4000, fail: true},
+		{name: "max version", created: now, updated: now, version: math.MaxUint64, fail: true},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			rec := channelMetaRecord{
+				Channel: TopicName(descr),
+				Topic:   "topic",
+				Created: c.created,
+				Creator: peer.Encode(pid),
+				Version: c.version,
+				Updated: c.updated,
+				Author:  peer.Encode(pid),
+			}
+			var err error
+			if rec.CreatorSig, err = key.Sign(rec.creatorData()); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Signature, err = key.Sign(rec.signedData()); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = rec.verify(descr)
+			if c.fail && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !c.fail && err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+		})
+	}
+}
+
+func TestVersionLimit(t *testing.T) {
+	if l := versionLimit(10, 1000, 500); l != 10+metaVersionBurst {
+		t.Errorf("older update: got %d", l)
+	}
+	if l := versionLimit(10, 1000, 61000); l != 10+metaVersionBurst+60 {
+		t.Errorf("a minute later: got %d", l)
+	}
+}
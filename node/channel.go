@@ -2,6 +2,8 @@ package infchat
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
@@ -19,8 +21,14 @@ func (n *Node) JoinChannel(descr string) error {
 		err   error
 		ok    bool
 	)
+	if IsPrivateChannel(descr) {
+		if _, _, err := parsePrivateChannel(descr); err != nil {
+			return fmt.Errorf("join failed: %w", err)
+		}
+	}
+
 	if topic, ok = n.topics[descr]; !ok {
-		topic, err = n.PubsubProto.Join(descr)
+		topic, err = n.PubsubProto.Join(TopicName(descr))
 		if err != nil {
 			return fmt.Errorf("join failed: %w", err)
 		}
@@ -34,17 +42,31 @@ func (n *Node) JoinChannel(descr string) error {
 	if err != nil {
 		return fmt.Errorf("join: subscribe failed: %w", err)
 	}
+	peerEvents, err := topic.EventHandler()
+	if err != nil {
+		subscription.Cancel()
+		return fmt.Errorf("join: event handler failed: %w", err)
+	}
+	peerEventsCtx, cancelPeerEvents := context.WithCancel(n.nodeContext)
 
 	n.topics[descr] = topic
 	n.subs[descr] = subscription
+	n.peerEventsStop[descr] = func() {
+		cancelPeerEvents()
+		peerEvents.Cancel()
+	}
 
-	go n.pullMessages(subscription)
+	go n.pullMessages(descr, subscription)
+	go n.pullPeerEvents(peerEventsCtx, descr, peerEvents)
 	go n.AnnounceChannel(descr)
 	go n.RejoinChannel(descr)
+	go n.syncHistoryOnJoin(descr)
+	go n.syncChannelMetaOnJoin(descr)
+	n.events.publish(JoinEvent{Channel: descr, Joined: true})
 	return nil
 }
 
-func (n *Node) pullMessages(sub *pubsub.Subscription) {
+func (n *Node) pullMessages(descr string, sub *pubsub.Subscription) {
 	for {
 		msg, err := sub.Next(n.nodeContext)
 		if err != nil {
@@ -54,7 +76,7 @@ func (n *Node) pullMessages(sub *pubsub.Subscription) {
 			if err == context.Canceled {
 				return
 			}
-			n.Cfg.Log.Printf("Pull for %s failed: %v", sub.Topic(), err)
+			n.Cfg.Log.Printf("Pull for %s failed: %v", RedactDescriptor(descr), err)
 			continue
 		}
 
@@ -62,13 +84,54 @@ func (n *Node) pullMessages(sub *pubsub.Subscription) {
 			continue
 		}
 
-		n.messages <- Message{
-			Sender:  msg.GetFrom(),
-			Channel: sub.Topic(),
-			Text:    string(msg.Data),
+		m, err := decodeChannelMessage(descr, msg)
+		if err != nil {
+			n.Cfg.Log.Printf("Malformed message from %v in %s: %v", msg.GetFrom(), RedactDescriptor(descr), err)
+			continue
+		}
+
+		n.deliver(m)
+	}
+
+}
+
+// decodeChannelMessage decrypts (for private channels) and decodes the pubsub
+// message received in the channel.
+func decodeChannelMessage(descr string, msg *pubsub.Message) (Message, error) {
+	m := Message{
+		Sender:  msg.GetFrom(),
+		Channel: descr,
+	}
+	payload := msg.Data
+	if IsPrivateChannel(descr) {
+		var err error
+		payload, err = openPayload(descr, msg.Data)
+		if err != nil {
+			return Message{}, fmt.Errorf("decrypt: %w", err)
 		}
 	}
+	if err := decodeMessage(payload, legacyMessageID(msg), &m); err != nil {
+		return Message{}, err
+	}
+	if len(msg.Signature) != 0 {
+		// Kept so the message can be relayed via history sync.
+		m.signed, _ = msg.Message.Marshal()
+	}
+	return m, nil
+}
 
+// joinedByTopic returns the descriptor of the joined channel that uses the
+// specified pubsub topic.
+func (n *Node) joinedByTopic(topicName string) (string, bool) {
+	n.pubsubLock.Lock()
+	defer n.pubsubLock.Unlock()
+
+	for descr := range n.subs {
+		if TopicName(descr) == topicName {
+			return descr, true
+		}
+	}
+	return "", false
 }
 
 func (n *Node) LeaveChannel(descr string) error {
@@ -83,7 +146,7 @@ func (n *Node) LeaveChannel(descr string) error {
 	// We are no longer interested in the connection to this peer
 	// ... unless it is a member of another channel we are part of.
 	for _, p := range topic.ListPeers() {
-		n.Host.ConnManager().Unprotect(p, descr)
+		n.Host.ConnManager().Unprotect(p, TopicName(descr))
 	}
 
 	sub, ok := n.subs[descr]
@@ -94,53 +157,127 @@ func (n *Node) LeaveChannel(descr string) error {
 	delete(n.subs, descr)
 	sub.Cancel()
 
+	if stop, ok := n.peerEventsStop[descr]; ok {
+		delete(n.peerEventsStop, descr)
+		stop()
+	}
+
 	delete(n.topics, descr)
+	n.events.publish(JoinEvent{Channel: descr, Joined: false})
 	if err := topic.Close(); err != nil {
 		return fmt.Errorf("failed to leave: %w", err)
 	}
 	return nil
 }
 
-func (n *Node) Post(descriptor, msg string) error {
+// legacyMessageID derives the message ID for messages in legacy format
+// from the pubsub message sender and sequence number.
+func legacyMessageID(msg *pubsub.Message) string {
+	digest := sha256.Sum256(append([]byte(msg.GetFrom()), msg.GetSeqno()...))
+	return hex.EncodeToString(digest[:12])
+}
+
+// Post sends the text message to the channel or peer referenced by the
+// descriptor.
+func (n *Node) Post(descriptor, text string) (*Delivery, error) {
+	return n.PostMessage(descriptor, Message{
+		Kind: KindText,
+		Text: text,
+	})
+}
+
+// Reply sends the text message to the channel or peer referenced by the
+// descriptor as a reply to the message with the specified ID.
+func (n *Node) Reply(descriptor, replyTo, text string) (*Delivery, error) {
+	if _, ok := n.lookupSender(descriptor, replyTo); !ok {
+		return nil, ErrUnknownMessage
+	}
+	return n.PostMessage(descriptor, Message{
+		Kind:    KindText,
+		Text:    text,
+		ReplyTo: replyTo,
+	})
+}
+
+// PostMessage sends the message to the channel or peer referenced by the
+// descriptor.
+//
+// ID, Sender, Channel and Timestamp fields are populated by PostMessage, the
+// resulting message is available via the returned Delivery handle that can
+// be used to track whether the message was actually sent.
+//
+// Channel messages are put into the outbox and sent once there are channel
+// peers to send them to, DeliveryEvent is generated when they are sent or
+// sending fails.
+func (n *Node) PostMessage(descriptor string, msg Message) (*Delivery, error) {
+	if msg.Kind == KindTyping {
+		return nil, errors.New("post: use SetTyping to send typing notifications")
+	}
+	if msg.Kind == KindTopic && msg.meta == nil {
+		return nil, errors.New("post: use SetChannelMeta to change the topic")
+	}
+	msg.ID = newMessageID()
+	msg.Sender = n.ID()
+	msg.Channel = descriptor
+	msg.Timestamp = time.Now()
+	if msg.Kind == "" {
+		msg.Kind = KindText
+	}
+
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return nil, fmt.Errorf("post: %w", err)
+	}
+
+	d := newDelivery(msg)
+
 	switch {
 	case strings.HasPrefix(descriptor, ChanPrefix):
-		n.pubsubLock.Lock()
-		defer n.pubsubLock.Unlock()
-		topic, ok := n.topics[descriptor]
-		if !ok {
-			return errors.New("not on the channel")
+		if !n.IsJoined(descriptor) {
+			return nil, errors.New("not on the channel")
+		}
+		if len(n.ConnectedMembers(descriptor)) == 0 {
+			n.Cfg.Log.Printf("No connected peers for channel, message will be sent once they appear")
 		}
 
-		go func() {
-			if len(topic.ListPeers()) == 0 {
-				n.Cfg.Log.Printf("No connected peers for channel, message will be queued and may be dropped")
-			}
-
-			if err := topic.Publish(n.nodeContext, []byte(msg),
-				pubsub.WithReadiness(pubsub.MinTopicSize(1)),
-			); err != nil {
-				n.Cfg.Log.Printf("Publish failed: %v", err)
-			}
-		}()
+		n.trackDelivery(d)
+		n.enqueue(msg, payload)
 	case strings.HasPrefix(descriptor, DMPrefix):
-		return errors.New("not implemented yet")
+		n.trackDelivery(d)
+		if err := n.postDM(msg, payload); err != nil {
+			n.deliveriesLock.Lock()
+			delete(n.deliveries, msg.ID)
+			n.deliveriesLock.Unlock()
+			return nil, err
+		}
 	default:
-		return errors.New("unknown descriptor type")
+		return nil, errors.New("unknown descriptor type")
 	}
 
-	return nil
+	if !changesMessage(msg.Kind) {
+		n.recent.add(msg)
+	}
+	n.seen.add(msg.ID)
+	n.recordHistory(msg)
+	n.resetTyping(descriptor)
+
+	if len(msg.Attachments) != 0 && n.shouldProvide(descriptor) {
+		go n.provideBlobs(msg.Attachments)
+	}
+
+	return d, nil
 }
 
 func (n *Node) AnnounceChannel(desc string) error {
-	_, err := n.Discover.Advertise(n.nodeContext, desc,
+	_, err := n.Discover.Advertise(n.nodeContext, TopicName(desc),
 		discovery.TTL(10*time.Minute))
 	return err
 }
 
 func (n *Node) RejoinChannel(desc string) error {
-	pis, err := n.Discover.FindPeers(n.nodeContext, desc, discovery.Limit(100))
+	pis, err := n.Discover.FindPeers(n.nodeContext, TopicName(desc), discovery.Limit(100))
 	if err != nil {
-		return fmt.Errorf("join: find peers %s: %w", desc, err)
+		return fmt.Errorf("join: find peers %s: %w", RedactDescriptor(desc), err)
 	}
 
 	// The whole thing should not take more than a minute.
@@ -157,6 +294,7 @@ func (n *Node) RejoinChannel(desc string) error {
 			// Not much we can do...
 			continue
 		}
+		n.refreshProfile(peer.ID)
 
 		// We do not want 100 protected connections for each channel.
 		// Even one connection should be enough to keep us part of the mesh
@@ -168,7 +306,7 @@ func (n *Node) RejoinChannel(desc string) error {
 		// Prevent connection manager from closing the connection we need.
 		// Using channel descriptor as protection tag as we can have protected
 		// connection as long as the peer is a member of any channels.
-		n.Host.ConnManager().Protect(peer.ID, desc)
+		n.Host.ConnManager().Protect(peer.ID, TopicName(desc))
 		protectedCount++
 	}
 
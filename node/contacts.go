@@ -0,0 +1,196 @@
+package infchat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Contact is an entry in the local address book.
+type Contact struct {
+	Petname string
+	Peer    peer.ID
+}
+
+// contactBook is the locally-managed mapping between peer IDs and
+// user-chosen petnames.
+//
+// Unlike nicknames, petnames are chosen by the user and are never
+// sent over the network so they can be trusted.
+type contactBook struct {
+	path string
+
+	byName map[string]peer.ID
+	byPeer map[peer.ID]string
+}
+
+func loadContacts(path string) (*contactBook, error) {
+	cb := &contactBook{
+		path:   path,
+		byName: map[string]peer.ID{},
+		byPeer: map[peer.ID]string{},
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cb, nil
+		}
+		return nil, fmt.Errorf("contacts: %w", err)
+	}
+
+	// petname -> peer ID
+	var raw map[string]string
+	if err := json.Unmarshal(blob, &raw); err != nil {
+		return nil, fmt.Errorf("contacts: %w", err)
+	}
+	for name, pidStr := range raw {
+		pid, err := peer.Decode(pidStr)
+		if err != nil {
+			return nil, fmt.Errorf("contacts: %s: %w", name, err)
+		}
+		cb.byName[name] = pid
+		cb.byPeer[pid] = name
+	}
+
+	return cb, nil
+}
+
+func (cb *contactBook) save() error {
+	raw := make(map[string]string, len(cb.byName))
+	for name, pid := range cb.byName {
+		raw[name] = peer.Encode(pid)
+	}
+	blob, err := json.MarshalIndent(raw, "", "\t")
+	if err != nil {
+		return fmt.Errorf("contacts: %w", err)
+	}
+
+	// Write to the temporary file first so we will not lose everything if
+	// we crash in the middle.
+	if err := ioutil.WriteFile(cb.path+".tmp", blob, 0600); err != nil {
+		return fmt.Errorf("contacts: %w", err)
+	}
+	if err := os.Rename(cb.path+".tmp", cb.path); err != nil {
+		return fmt.Errorf("contacts: %w", err)
+	}
+	return nil
+}
+
+// AddContact saves the peer to the local address book under the specified
+// petname, replacing the previous petname of the peer, if any.
+func (n *Node) AddContact(petname string, pid peer.ID) error {
+	if petname == "" {
+		return errors.New("contacts: empty petname")
+	}
+	if err := CheckNickname(petname); err != nil {
+		return fmt.Errorf("contacts: %w", err)
+	}
+
+	n.contactsLock.Lock()
+	defer n.contactsLock.Unlock()
+
+	if n.contacts == nil {
+		return errors.New("contacts: address book is disabled")
+	}
+	if other, ok := n.contacts.byName[petname]; ok && other != pid {
+		return fmt.Errorf("contacts: %s is already used for %v", petname, other)
+	}
+
+	if oldName, ok := n.contacts.byPeer[pid]; ok {
+		delete(n.contacts.byName, oldName)
+	}
+	n.contacts.byName[petname] = pid
+	n.contacts.byPeer[pid] = petname
+
+	return n.contacts.save()
+}
+
+// RemoveContact removes the peer with the specified petname from the local
+// address book.
+func (n *Node) RemoveContact(petname string) error {
+	n.contactsLock.Lock()
+	defer n.contactsLock.Unlock()
+
+	if n.contacts == nil {
+		return errors.New("contacts: address book is disabled")
+	}
+	pid, ok := n.contacts.byName[petname]
+	if !ok {
+		return errors.New("contacts: no such contact")
+	}
+	delete(n.contacts.byName, petname)
+	delete(n.contacts.byPeer, pid)
+
+	return n.contacts.save()
+}
+
+// Contacts returns the contents of the local address book sorted by petname.
+func (n *Node) Contacts() []Contact {
+	n.contactsLock.Lock()
+	defer n.contactsLock.Unlock()
+
+	if n.contacts == nil {
+		return nil
+	}
+
+	res := make([]Contact, 0, len(n.contacts.byName))
+	for name, pid := range n.contacts.byName {
+		res = append(res, Contact{Petname: name, Peer: pid})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Petname < res[j].Petname
+	})
+	return res
+}
+
+// Petname returns the name assigned to the peer in the local address book or
+// empty string if the peer is not there.
+func (n *Node) Petname(pid peer.ID) string {
+	n.contactsLock.Lock()
+	defer n.contactsLock.Unlock()
+
+	if n.contacts == nil {
+		return ""
+	}
+	return n.contacts.byPeer[pid]
+}
+
+func (n *Node) contactByName(petname string) (peer.ID, bool) {
+	n.contactsLock.Lock()
+	defer n.contactsLock.Unlock()
+
+	if n.contacts == nil {
+		return "", false
+	}
+	pid, ok := n.contacts.byName[petname]
+	return pid, ok
+}
+
+// ExpandDescriptor is the version of the ExpandDescriptor function that
+// also resolves @petname descriptors using the local address book.
+func (n *Node) ExpandDescriptor(shortForm string) (string, error) {
+	if strings.HasPrefix(shortForm, "@") {
+		if pid, ok := n.contactByName(shortForm[1:]); ok {
+			return DMDescriptor(pid), nil
+		}
+	}
+	return ExpandDescriptor(shortForm)
+}
+
+// DescriptorForDisplay is the version of the DescriptorForDisplay function
+// that uses petnames from the local address book for DM descriptors.
+func (n *Node) DescriptorForDisplay(fullForm string) string {
+	if pid, err := DMPeer(fullForm); err == nil {
+		if petname := n.Petname(pid); petname != "" {
+			return "@" + petname
+		}
+	}
+	return DescriptorForDisplay(fullForm)
+}
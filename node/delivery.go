@@ -0,0 +1,99 @@
+package infchat
+
+import (
+	"context"
+	"sync"
+)
+
+// Delivery tracks the delivery state of the message posted using
+// Node.PostMessage.
+type Delivery struct {
+	// Message as it was sent, with ID, Sender and Timestamp populated.
+	Message Message
+
+	lock  sync.Mutex
+	state DeliveryState
+	peers int
+	err   error
+	done  chan struct{}
+}
+
+func newDelivery(msg Message) *Delivery {
+	return &Delivery{
+		Message: msg,
+		state:   DeliveryPending,
+		done:    make(chan struct{}),
+	}
+}
+
+// Done returns the channel that is closed once the message is sent or
+// sending fails.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// State returns the current delivery state, amount of peers the message was
+// sent to and the failure reason, if any.
+func (d *Delivery) State() (DeliveryState, int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.state, d.peers, d.err
+}
+
+// Wait blocks until the message is sent or sending fails and returns the
+// amount of peers the message was sent to.
+func (d *Delivery) Wait(ctx context.Context) (int, error) {
+	select {
+	case <-d.done:
+		_, peers, err := d.State()
+		return peers, err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// OnDone calls cb in a separate goroutine once the message is sent or
+// sending fails.
+func (d *Delivery) OnDone(cb func(state DeliveryState, peers int, err error)) {
+	go func() {
+		<-d.done
+		cb(d.State())
+	}()
+}
+
+func (d *Delivery) resolve(ev DeliveryEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state != DeliveryPending {
+		return
+	}
+	d.state = ev.State
+	d.peers = ev.Peers
+	d.err = ev.Err
+	close(d.done)
+}
+
+// trackDelivery registers the handle so reportDelivery can update it.
+func (n *Node) trackDelivery(d *Delivery) {
+	n.deliveriesLock.Lock()
+	defer n.deliveriesLock.Unlock()
+	n.deliveries[d.Message.ID] = d
+}
+
+// reportDelivery updates the handle for the message (if we have one) and
+// notifies subscribers about the delivery state change.
+func (n *Node) reportDelivery(ev DeliveryEvent) {
+	if ev.State != DeliveryPending {
+		n.deliveriesLock.Lock()
+		d, ok := n.deliveries[ev.MessageID]
+		delete(n.deliveries, ev.MessageID)
+		n.deliveriesLock.Unlock()
+
+		if ok {
+			d.resolve(ev)
+		}
+	}
+
+	n.events.publish(ev)
+}
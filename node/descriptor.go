@@ -2,7 +2,10 @@ package infchat
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 const (
@@ -24,12 +27,22 @@ func ExpandDescriptor(shortForm string) (string, error) {
 	case strings.HasPrefix(shortForm, "#"):
 		return ChanPrefix + shortForm[1:], nil
 	case strings.HasPrefix(shortForm, "@"):
-		return DMPrefix + shortForm[1:], nil
+		pid, err := peer.Decode(shortForm[1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid peer ID: %w", err)
+		}
+		return DMDescriptor(pid), nil
 	default:
 		return "", errors.New("unknown descriptor type")
 	}
 }
 
+// DescriptorForDisplay converts the descriptor into the short form. See
+// ExpandDescriptor for reverse conversion.
+//
+// Short form of private channel descriptors still contains the key, so it
+// should not be shown anywhere other people might see it. Use
+// RedactDescriptor for that.
 func DescriptorForDisplay(fullForm string) string {
 	switch {
 	case strings.HasPrefix(fullForm, "#"), strings.HasPrefix(fullForm, "@"):
@@ -42,3 +55,19 @@ func DescriptorForDisplay(fullForm string) string {
 		return fullForm
 	}
 }
+
+// RedactDescriptor converts the descriptor into the short form with the
+// private channel key removed. It should be used for logs and everything
+// shown to the user except for invitations.
+//
+// Result can not be expanded back.
+func RedactDescriptor(descr string) string {
+	short := DescriptorForDisplay(descr)
+	if !strings.HasPrefix(short, "#") {
+		return short
+	}
+	if i := strings.IndexByte(short, ':'); i != -1 {
+		return short[:i] + ":***"
+	}
+	return short
+}
@@ -0,0 +1,122 @@
+package infchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// DMProtocol is the stream protocol used to deliver direct messages.
+//
+// Each message is sent using a separate stream. Sender writes the message
+// and closes the stream, recipient reads everything until EOF.
+const DMProtocol protocol.ID = "/infinitychat/v0.1/dm"
+
+// MaxDMSize is the maximum size of a single direct message accepted from
+// remote peers.
+const MaxDMSize = 64 * 1024
+
+// DMDescriptor returns the full descriptor of the direct conversation with
+// the specified peer.
+func DMDescriptor(pid peer.ID) string {
+	return DMPrefix + peer.Encode(pid)
+}
+
+// DMPeer extracts the peer ID from the direct conversation descriptor.
+func DMPeer(descr string) (peer.ID, error) {
+	if !strings.HasPrefix(descr, DMPrefix) {
+		return "", errors.New("not a DM descriptor")
+	}
+	return peer.Decode(strings.TrimPrefix(descr, DMPrefix))
+}
+
+func (n *Node) postDM(msg Message, payload []byte) error {
+	pid, err := DMPeer(msg.Channel)
+	if err != nil {
+		return fmt.Errorf("dm: %w", err)
+	}
+	if pid == n.ID() {
+		return errors.New("dm: talking to yourself is not supported")
+	}
+	if len(payload) > MaxDMSize {
+		return errors.New("dm: message is too big")
+	}
+
+	ev := DeliveryEvent{
+		Channel:   msg.Channel,
+		MessageID: msg.ID,
+		State:     DeliveryPending,
+	}
+	n.reportDelivery(ev)
+
+	go func() {
+		if err := n.sendDM(pid, payload); err != nil {
+			n.Cfg.Log.Printf("DM to %v failed: %v", pid, err)
+			ev.State = DeliveryFailed
+			ev.Err = err
+		} else {
+			ev.State = DeliverySent
+			ev.Peers = 1
+		}
+		n.reportDelivery(ev)
+	}()
+
+	return nil
+}
+
+func (n *Node) sendDM(pid peer.ID, data []byte) error {
+	// Might involve DHT lookup for peer addresses so give it some time.
+	ctx, cancel := context.WithTimeout(n.nodeContext, 30*time.Second)
+	defer cancel()
+
+	s, err := n.Host.NewStream(ctx, pid, DMProtocol)
+	if err != nil {
+		return err
+	}
+
+	s.SetWriteDeadline(time.Now().Add(15 * time.Second))
+	if _, err := s.Write(data); err != nil {
+		s.Reset()
+		return err
+	}
+
+	return s.Close()
+}
+
+func (n *Node) handleDMStream(s network.Stream) {
+	defer s.Close()
+
+	remote := s.Conn().RemotePeer()
+
+	s.SetReadDeadline(time.Now().Add(15 * time.Second))
+	data, err := ioutil.ReadAll(io.LimitReader(s, MaxDMSize+1))
+	if err != nil {
+		n.Cfg.Log.Printf("DM from %v: read failed: %v", remote, err)
+		s.Reset()
+		return
+	}
+	if len(data) > MaxDMSize {
+		n.Cfg.Log.Printf("DM from %v: message is too big, dropping", remote)
+		s.Reset()
+		return
+	}
+
+	msg := Message{
+		Sender:  remote,
+		Channel: DMDescriptor(remote),
+	}
+	if err := decodeMessage(data, newMessageID(), &msg); err != nil {
+		n.Cfg.Log.Printf("DM from %v: %v", remote, err)
+		return
+	}
+
+	n.deliver(msg)
+}
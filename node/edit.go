@@ -0,0 +1,219 @@
+package infchat
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Edits and deletions are sent as regular messages of KindEdit and
+// KindDelete kinds referencing the original message via Target. They are
+// honored only if they come from the author of the original message. Pubsub
+// messages are signed and signatures are verified by the router (or by
+// verifyChannelMessage for messages relayed via history sync), so the sender
+// of the change can be trusted.
+
+// Amount of recent messages remembered to check edits and deletions even if
+// the history is disabled. Reactions are aggregated only for these messages.
+const recentMessagesSize = 4096
+
+var (
+	ErrUnknownMessage  = errors.New("unknown message")
+	ErrAmbiguousRef    = errors.New("message reference is ambiguous")
+	ErrNotMessageOwner = errors.New("message was sent by somebody else")
+)
+
+type recentMessage struct {
+	ID      string
+	Channel string
+	Sender  peer.ID
+	File    *FileInfo
+
+	Attachments []FileInfo
+
+	// Peers that reacted to the message, by reaction.
+	reactions map[string]map[peer.ID]struct{}
+}
+
+// recentMessages is a bounded index of recently seen messages.
+type recentMessages struct {
+	lock sync.Mutex
+	// Ring buffer, next points to the oldest entry once it is full.
+	ring []*recentMessage
+	next int
+	byID map[string]*recentMessage
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{
+		ring: make([]*recentMessage, 0, recentMessagesSize),
+		byID: make(map[string]*recentMessage, recentMessagesSize),
+	}
+}
+
+func (r *recentMessages) add(msg Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rm := r.addLocked(msg.ID, msg.Channel, msg.Sender)
+	rm.File = msg.File
+	rm.Attachments = msg.Attachments
+}
+
+func (r *recentMessages) addLocked(id, channel string, sender peer.ID) *recentMessage {
+	if rm, ok := r.byID[id]; ok {
+		return rm
+	}
+	rm := &recentMessage{ID: id, Channel: channel, Sender: sender}
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, rm)
+	} else {
+		delete(r.byID, r.ring[r.next].ID)
+		r.ring[r.next] = rm
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	r.byID[id] = rm
+	return rm
+}
+
+func (r *recentMessages) get(id string) (recentMessage, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rm, ok := r.byID[id]
+	if !ok {
+		return recentMessage{}, false
+	}
+	return recentMessage{
+		ID:          rm.ID,
+		Channel:     rm.Channel,
+		Sender:      rm.Sender,
+		File:        rm.File,
+		Attachments: rm.Attachments,
+	}, true
+}
+
+// find returns IDs of messages in the channel starting with prefix, most
+// recent first.
+func (r *recentMessages) find(descr, prefix string, sender peer.ID) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var ids []string
+	for i := len(r.ring) - 1; i >= 0; i-- {
+		rm := r.ring[(r.next+i)%len(r.ring)]
+		if rm.Channel != descr || !strings.HasPrefix(rm.ID, prefix) {
+			continue
+		}
+		if sender != "" && rm.Sender != sender {
+			continue
+		}
+		ids = append(ids, rm.ID)
+	}
+	return ids
+}
+
+// lookupSender returns the sender of the message in the channel using the
+// recent messages index or the history.
+//
+// Unverified messages are not considered, their sender could be anybody.
+func (n *Node) lookupSender(descr, id string) (peer.ID, bool) {
+	if rm, ok := n.recent.get(id); ok {
+		return rm.Sender, rm.Channel == descr
+	}
+	if n.history == nil {
+		return "", false
+	}
+
+	sender, ok, err := n.history.Sender(descr, id)
+	if err != nil {
+		n.Cfg.Log.Printf("Message lookup failed: %v", err)
+		return "", false
+	}
+	return sender, ok
+}
+
+// checkEdit reports whether the received KindEdit or KindDelete message
+// should be honored.
+func (n *Node) checkEdit(msg Message) bool {
+	if msg.Target == "" {
+		n.Cfg.Log.Printf("Malformed %s from %v in %s: no target", msg.Kind, msg.Sender, RedactDescriptor(msg.Channel))
+		return false
+	}
+	sender, ok := n.lookupSender(msg.Channel, msg.Target)
+	if !ok {
+		n.Cfg.Log.Printf("Ignoring %s of unknown message %s from %v", msg.Kind, msg.Target, msg.Sender)
+		return false
+	}
+	if sender != msg.Sender {
+		n.Cfg.Log.Printf("Ignoring %s of message %s from %v: not the author", msg.Kind, msg.Target, msg.Sender)
+		return false
+	}
+	return true
+}
+
+// ResolveMessageID returns the full ID of the recent message in the channel
+// referenced by ref. ref can be the full ID or its unique prefix.
+func (n *Node) ResolveMessageID(descr, ref string) (string, error) {
+	if ref == "" {
+		return "", ErrUnknownMessage
+	}
+	ids := n.recent.find(descr, ref, "")
+	switch len(ids) {
+	case 0:
+		if _, ok := n.lookupSender(descr, ref); ok {
+			return ref, nil
+		}
+		return "", ErrUnknownMessage
+	case 1:
+		return ids[0], nil
+	default:
+		return "", ErrAmbiguousRef
+	}
+}
+
+// LastOwnMessage returns the ID of the last recent message we posted to the
+// channel.
+func (n *Node) LastOwnMessage(descr string) (string, bool) {
+	ids := n.recent.find(descr, "", n.ID())
+	if len(ids) == 0 {
+		return "", false
+	}
+	return ids[0], true
+}
+
+func (n *Node) checkOwnMessage(descr, id string) error {
+	sender, ok := n.lookupSender(descr, id)
+	if !ok {
+		return ErrUnknownMessage
+	}
+	if sender != n.ID() {
+		return ErrNotMessageOwner
+	}
+	return nil
+}
+
+// EditMessage replaces the text of the message we previously posted to the
+// channel or peer referenced by the descriptor.
+func (n *Node) EditMessage(descr, id, text string) (*Delivery, error) {
+	if err := n.checkOwnMessage(descr, id); err != nil {
+		return nil, err
+	}
+	return n.PostMessage(descr, Message{
+		Kind:   KindEdit,
+		Target: id,
+		Text:   text,
+	})
+}
+
+// DeleteMessage removes the message we previously posted to the channel or
+// peer referenced by the descriptor.
+func (n *Node) DeleteMessage(descr, id string) (*Delivery, error) {
+	if err := n.checkOwnMessage(descr, id); err != nil {
+		return nil, err
+	}
+	return n.PostMessage(descr, Message{
+		Kind:   KindDelete,
+		Target: id,
+	})
+}
@@ -0,0 +1,225 @@
+package infchat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/foxcpp/infinitychat/node/pb"
+)
+
+// EnvelopeVersion is the version of the wire format produced by this
+// implementation.
+//
+// Version 0 is the "legacy" format where message payload is the raw message
+// text. Version 1 is the JSON object described by jsonEnvelope, it is still
+// accepted but no longer sent. Version 2 is the protobuf-encoded
+// pb.Envelope, see node/pb/envelope.proto.
+const EnvelopeVersion = 2
+
+type MessageKind string
+
+const (
+	KindText   MessageKind = "text"
+	KindAction MessageKind = "action"
+	KindNotice MessageKind = "notice"
+	KindSystem MessageKind = "system"
+
+	// KindEdit replaces the text of the message referenced by Target.
+	KindEdit MessageKind = "edit"
+	// KindDelete removes the message referenced by Target.
+	KindDelete MessageKind = "delete"
+	// KindReaction adds the reaction (emoji or a short string in Text) to
+	// the message referenced by Target.
+	KindReaction MessageKind = "reaction"
+	// KindFile offers the file described by File for download, see
+	// FileProtocol.
+	KindFile MessageKind = "file"
+	// KindTyping is an ephemeral notification sent by Node.SetTyping, Text
+	// is the TypingState. It is never stored or relayed.
+	KindTyping MessageKind = "typing"
+	// KindTopic changes the channel metadata, Text is the new topic and
+	// Meta is the signed record, see ChannelMetaProtocol.
+	KindTopic MessageKind = "topic"
+)
+
+// changesMessage reports whether messages of the kind change the message
+// referenced by Target instead of being shown on their own.
+func changesMessage(kind MessageKind) bool {
+	return kind == KindEdit || kind == KindDelete || kind == KindReaction
+}
+
+// jsonEnvelope is the version 1 wire format, a UTF-8 JSON object, e.g.:
+//
+//	{"v":1,"id":"5f0c1e...","ts":1588000000000,"kind":"text","text":"hi"}
+//
+// It is still accepted from older clients.
+type jsonEnvelope struct {
+	Version     int                `json:"v"`
+	ID          string             `json:"id"`
+	Timestamp   int64              `json:"ts"` // Unix time in milliseconds, as claimed by the sender.
+	Kind        MessageKind        `json:"kind,omitempty"`
+	Text        string             `json:"text"`
+	ReplyTo     string             `json:"reply_to,omitempty"`
+	Target      string             `json:"target,omitempty"`
+	File        *FileInfo          `json:"file,omitempty"`
+	Attachments []FileInfo         `json:"attachments,omitempty"`
+	Meta        *channelMetaRecord `json:"meta,omitempty"`
+	Extensions  map[string]string  `json:"ext,omitempty"`
+}
+
+func newMessageID() string {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// encodeMessage serializes msg as pb.Envelope.
+//
+// Since version is the first field, encoded envelopes always start with
+// 0x08 0x02, this is how decodeMessage tells them apart from other formats.
+// For private channels, the serialized envelope is sealed as a whole, see
+// sealPayload.
+func encodeMessage(msg Message) ([]byte, error) {
+	env := pb.Envelope{
+		Version:    EnvelopeVersion,
+		Id:         msg.ID,
+		Timestamp:  msg.Timestamp.UnixNano() / int64(time.Millisecond),
+		Kind:       string(msg.Kind),
+		Text:       msg.Text,
+		ReplyTo:    msg.ReplyTo,
+		Target:     msg.Target,
+		File:       fileInfoToPB(msg.File),
+		Meta:       metaToPB(msg.meta),
+		Extensions: msg.Extensions,
+	}
+	for i := range msg.Attachments {
+		env.Attachments = append(env.Attachments, fileInfoToPB(&msg.Attachments[i]))
+	}
+	return env.Marshal()
+}
+
+// decodeMessage parses the payload and fills corresponding fields of msg.
+//
+// Sender and Channel fields are not touched and should be populated by the
+// caller. legacyID is used as the message ID if payload is in the legacy
+// format.
+func decodeMessage(payload []byte, legacyID string, msg *Message) error {
+	switch {
+	case len(payload) >= 2 && payload[0] == 0x08:
+		var env pb.Envelope
+		if err := env.Unmarshal(payload); err != nil || env.Version < 2 || env.Id == "" {
+			// Raw text starting with a backspace, unlikely but possible.
+			decodeLegacy(payload, legacyID, msg)
+			return nil
+		}
+
+		msg.ID = env.Id
+		msg.Timestamp = time.Unix(0, env.Timestamp*int64(time.Millisecond))
+		msg.Kind = MessageKind(env.Kind)
+		msg.Text = env.Text
+		msg.ReplyTo = env.ReplyTo
+		msg.Target = env.Target
+		msg.File = fileInfoFromPB(env.File)
+		msg.Attachments = nil
+		for _, a := range env.Attachments {
+			if a != nil {
+				msg.Attachments = append(msg.Attachments, *fileInfoFromPB(a))
+			}
+		}
+		msg.meta = metaFromPB(env.Meta)
+		msg.Extensions = env.Extensions
+	case bytes.HasPrefix(payload, []byte("{")):
+		var env jsonEnvelope
+		if err := json.Unmarshal(payload, &env); err != nil || env.Version == 0 {
+			// Probably someone just typed "{" in the old client.
+			decodeLegacy(payload, legacyID, msg)
+			return nil
+		}
+		if env.ID == "" {
+			return errors.New("envelope: missing message ID")
+		}
+
+		msg.ID = env.ID
+		msg.Timestamp = time.Unix(0, env.Timestamp*int64(time.Millisecond))
+		msg.Kind = env.Kind
+		msg.Text = env.Text
+		msg.ReplyTo = env.ReplyTo
+		msg.Target = env.Target
+		msg.File = env.File
+		msg.Attachments = env.Attachments
+		msg.meta = env.Meta
+		msg.Extensions = env.Extensions
+	default:
+		decodeLegacy(payload, legacyID, msg)
+		return nil
+	}
+
+	if msg.Kind == "" {
+		msg.Kind = KindText
+	}
+	return nil
+}
+
+func decodeLegacy(payload []byte, legacyID string, msg *Message) {
+	msg.ID = legacyID
+	msg.Timestamp = time.Now()
+	msg.Kind = KindText
+	msg.Text = string(payload)
+	msg.Legacy = true
+}
+
+func fileInfoToPB(info *FileInfo) *pb.FileInfo {
+	if info == nil {
+		return nil
+	}
+	return &pb.FileInfo{Name: info.Name, Size_: info.Size, Sha256: info.Hash}
+}
+
+func fileInfoFromPB(info *pb.FileInfo) *FileInfo {
+	if info == nil {
+		return nil
+	}
+	return &FileInfo{Name: info.Name, Size: info.Size_, Hash: info.Sha256}
+}
+
+func metaToPB(rec *channelMetaRecord) *pb.ChannelMeta {
+	if rec == nil {
+		return nil
+	}
+	return &pb.ChannelMeta{
+		Channel:     rec.Channel,
+		Topic:       rec.Topic,
+		Description: rec.Description,
+		Created:     rec.Created,
+		Creator:     rec.Creator,
+		CreatorSig:  rec.CreatorSig,
+		Version:     rec.Version,
+		Updated:     rec.Updated,
+		Author:      rec.Author,
+		Signature:   rec.Signature,
+	}
+}
+
+func metaFromPB(rec *pb.ChannelMeta) *channelMetaRecord {
+	if rec == nil {
+		return nil
+	}
+	return &channelMetaRecord{
+		Channel:     rec.Channel,
+		Topic:       rec.Topic,
+		Description: rec.Description,
+		Created:     rec.Created,
+		Creator:     rec.Creator,
+		CreatorSig:  rec.CreatorSig,
+		Version:     rec.Version,
+		Updated:     rec.Updated,
+		Author:      rec.Author,
+		Signature:   rec.Signature,
+	}
+}
@@ -0,0 +1,167 @@
+package infchat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	const legacyID = "legacy-id"
+
+	cases := []struct {
+		name    string
+		payload string
+
+		id     string
+		kind   MessageKind
+		text   string
+		legacy bool
+		fail   bool
+	}{
+		{
+			name:    "protobuf envelope",
+			payload: "\x08\x02\x12\x03abc\x22\x06action\x2a\x05waves",
+			id:      "abc",
+			kind:    KindAction,
+			text:    "waves",
+		},
+		{
+			name:    "protobuf envelope with unknown fields",
+			payload: "\x08\x03\x12\x03abc\x2a\x02hi\xa2\x06\x02\x01\x02",
+			id:      "abc",
+			kind:    KindText,
+			text:    "hi",
+		},
+		{
+			name:    "legacy text starting with backspace",
+			payload: "\x08\x02hi",
+			id:      legacyID,
+			kind:    KindText,
+			text:    "\x08\x02hi",
+			legacy:  true,
+		},
+		{
+			name:    "JSON envelope",
+			payload: `{"v":1,"id":"abc","ts":1588000000000,"kind":"action","text":"waves"}`,
+			id:      "abc",
+			kind:    KindAction,
+			text:    "waves",
+		},
+		{
+			name:    "JSON envelope without kind",
+			payload: `{"v":1,"id":"abc","ts":1588000000000,"text":"hi"}`,
+			id:      "abc",
+			kind:    KindText,
+			text:    "hi",
+		},
+		{
+			name:    "JSON envelope with unknown fields",
+			payload: `{"v":2,"id":"abc","ts":1588000000000,"text":"hi","future":[1,2]}`,
+			id:      "abc",
+			kind:    KindText,
+			text:    "hi",
+		},
+		{
+			name:    "JSON envelope without ID",
+			payload: `{"v":1,"text":"hi"}`,
+			fail:    true,
+		},
+		{
+			name:    "legacy text",
+			payload: "hello",
+			id:      legacyID,
+			kind:    KindText,
+			text:    "hello",
+			legacy:  true,
+		},
+		{
+			name:    "legacy text starting with brace",
+			payload: "{ not json",
+			id:      legacyID,
+			kind:    KindText,
+			text:    "{ not json",
+			legacy:  true,
+		},
+		{
+			name:    "legacy JSON-looking text",
+			payload: `{"text":"hi"}`,
+			id:      legacyID,
+			kind:    KindText,
+			text:    `{"text":"hi"}`,
+			legacy:  true,
+		},
+		{
+			name:    "empty",
+			payload: "",
+			id:      legacyID,
+			kind:    KindText,
+			text:    "",
+			legacy:  true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			var msg Message
+			err := decodeMessage([]byte(c.payload), legacyID, &msg)
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if msg.ID != c.id {
+				t.Errorf("wrong ID: want %q, got %q", c.id, msg.ID)
+			}
+			if msg.Kind != c.kind {
+				t.Errorf("wrong kind: want %q, got %q", c.kind, msg.Kind)
+			}
+			if msg.Text != c.text {
+				t.Errorf("wrong text: want %q, got %q", c.text, msg.Text)
+			}
+			if msg.Legacy != c.legacy {
+				t.Errorf("wrong legacy flag: want %v, got %v", c.legacy, msg.Legacy)
+			}
+		})
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	in := Message{
+		ID:          newMessageID(),
+		Timestamp:   time.Unix(1588000000, 123000000),
+		Kind:        KindEdit,
+		Text:        "fixed",
+		Target:      "abc",
+		Attachments: []FileInfo{{Name: "a.png", Size: 3, Hash: "00ff"}},
+		Extensions:  map[string]string{"x-test": "1"},
+	}
+	payload, err := encodeMessage(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out Message
+	if err := decodeMessage(payload, "legacy-id", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != in.ID || out.Kind != in.Kind || out.Text != in.Text || out.Target != in.Target {
+		t.Errorf("message changed: want %+v, got %+v", in, out)
+	}
+	if !out.Timestamp.Equal(in.Timestamp) {
+		t.Errorf("wrong timestamp: want %v, got %v", in.Timestamp, out.Timestamp)
+	}
+	if len(out.Attachments) != 1 || out.Attachments[0] != in.Attachments[0] {
+		t.Errorf("wrong attachments: want %v, got %v", in.Attachments, out.Attachments)
+	}
+	if out.Extensions["x-test"] != "1" {
+		t.Errorf("wrong extensions: %v", out.Extensions)
+	}
+	if out.Legacy {
+		t.Error("message decoded as legacy")
+	}
+}
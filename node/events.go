@@ -0,0 +1,336 @@
+package infchat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// EventType identifies the kind of the Event.
+type EventType int
+
+const (
+	EventMessage EventType = iota
+	EventChannelPeer
+	EventConnection
+	EventReachability
+	EventPresence
+	EventDelivery
+	EventTyping
+	EventChannelMeta
+	EventJoin
+)
+
+// Event is one of MessageEvent, ChannelPeerEvent, ConnectionEvent,
+// ReachabilityEvent, PresenceEvent, DeliveryEvent, TypingEvent,
+// ChannelMetaEvent or JoinEvent.
+type Event interface {
+	Type() EventType
+}
+
+// MessageEvent is generated for each received message.
+type MessageEvent struct {
+	Message
+}
+
+func (MessageEvent) Type() EventType { return EventMessage }
+
+// ChannelPeerEvent is generated when the peer joins or leaves the channel
+// we are member of.
+type ChannelPeerEvent struct {
+	Channel string
+	Peer    peer.ID
+	Joined  bool
+}
+
+func (ChannelPeerEvent) Type() EventType { return EventChannelPeer }
+
+// JoinEvent is generated when we join or leave the channel.
+type JoinEvent struct {
+	Channel string
+	Joined  bool
+}
+
+func (JoinEvent) Type() EventType { return EventJoin }
+
+// ConnectionEvent is generated when the first connection to the peer is
+// established or the last one is closed.
+type ConnectionEvent struct {
+	Peer      peer.ID
+	Addr      multiaddr.Multiaddr
+	Connected bool
+}
+
+func (ConnectionEvent) Type() EventType { return EventConnection }
+
+// ReachabilityEvent is generated when AutoNAT changes its opinion on whether
+// we are reachable from the outside.
+type ReachabilityEvent struct {
+	Reachability network.Reachability
+}
+
+func (ReachabilityEvent) Type() EventType { return EventReachability }
+
+// OverflowPolicy defines what happens when the subscriber does not keep up
+// and its buffer is full.
+type OverflowPolicy int
+
+const (
+	// Discard the oldest buffered event to make room for the new one.
+	DropOldest OverflowPolicy = iota
+	// Discard the new event.
+	DropNewest
+)
+
+const DefaultEventBuffer = 256
+
+var ErrClosed = errors.New("node is closed")
+
+// EventFilter selects which events are delivered to the subscriber and how
+// they are buffered.
+type EventFilter struct {
+	// Deliver only events of the listed types. All events are delivered if
+	// it is empty.
+	Types []EventType
+
+	// Deliver message, channel peer, typing, channel meta and join events
+	// only for the listed channels.
+	// Other events are not affected.
+	Channels []string
+
+	// Amount of events buffered for the subscriber. DefaultEventBuffer is
+	// used if it is zero.
+	BufferSize int
+
+	Overflow OverflowPolicy
+}
+
+func (f *EventFilter) match(ev Event) bool {
+	if len(f.Types) != 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == ev.Type() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Channels) == 0 {
+		return true
+	}
+	var channel string
+	switch ev := ev.(type) {
+	case MessageEvent:
+		channel = ev.Channel
+	case ChannelPeerEvent:
+		channel = ev.Channel
+	case TypingEvent:
+		channel = ev.Channel
+	case ChannelMetaEvent:
+		channel = ev.Channel
+	case JoinEvent:
+		channel = ev.Channel
+	default:
+		return true
+	}
+	for _, c := range f.Channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription is the stream of node events created by Node.Subscribe.
+type Subscription struct {
+	bus     *eventBus
+	filter  EventFilter
+	ch      chan Event
+	dropped uint64
+}
+
+// Events returns the channel events are delivered to. It is closed when the
+// subscription or the node is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the amount of events discarded due to the buffer overflow.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+type eventBus struct {
+	lock   sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[*Subscription]struct{}{}}
+}
+
+func (b *eventBus) remove(s *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.ch)
+}
+
+func (b *eventBus) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for s := range b.subs {
+		close(s.ch)
+	}
+	b.subs = nil
+	b.closed = true
+}
+
+// publish passes the event to all matching subscribers. It never blocks.
+func (b *eventBus) publish(ev Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for s := range b.subs {
+		if !s.filter.match(ev) {
+			continue
+		}
+
+		select {
+		case s.ch <- ev:
+			continue
+		default:
+		}
+
+		atomic.AddUint64(&s.dropped, 1)
+		if s.filter.Overflow == DropNewest {
+			continue
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+		select {
+		case s.ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe creates the new independent stream of node events matching the
+// filter.
+//
+// Subscriber that does not keep up loses events according to
+// filter.Overflow, it never blocks the node.
+func (n *Node) Subscribe(filter EventFilter) (*Subscription, error) {
+	if filter.BufferSize < 0 {
+		return nil, errors.New("subscribe: negative buffer size")
+	}
+	if filter.BufferSize == 0 {
+		filter.BufferSize = DefaultEventBuffer
+	}
+
+	s := &Subscription{
+		bus:    n.events,
+		filter: filter,
+		ch:     make(chan Event, filter.BufferSize),
+	}
+
+	n.events.lock.Lock()
+	defer n.events.lock.Unlock()
+	if n.events.closed {
+		return nil, ErrClosed
+	}
+	n.events.subs[s] = struct{}{}
+	return s, nil
+}
+
+// watchConnections generates ConnectionEvent for the network state changes.
+func (n *Node) watchConnections() {
+	n.Host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(net network.Network, conn network.Conn) {
+			if len(net.ConnsToPeer(conn.RemotePeer())) != 1 {
+				return
+			}
+			n.events.publish(ConnectionEvent{
+				Peer:      conn.RemotePeer(),
+				Addr:      conn.RemoteMultiaddr(),
+				Connected: true,
+			})
+		},
+		DisconnectedF: func(net network.Network, conn network.Conn) {
+			if net.Connectedness(conn.RemotePeer()) == network.Connected {
+				return
+			}
+			n.events.publish(ConnectionEvent{
+				Peer:      conn.RemotePeer(),
+				Addr:      conn.RemoteMultiaddr(),
+				Connected: false,
+			})
+		},
+	})
+}
+
+// watchReachability generates ReachabilityEvent for the changes reported by
+// AutoNAT.
+func (n *Node) watchReachability(sub event.Subscription) {
+	defer sub.Close()
+	for {
+		select {
+		case ev, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			n.events.publish(ReachabilityEvent{
+				Reachability: ev.(event.EvtLocalReachabilityChanged).Reachability,
+			})
+		case <-n.nodeContext.Done():
+			return
+		}
+	}
+}
+
+// pullPeerEvents generates ChannelPeerEvent for the channel members.
+//
+// ctx should be cancelled when the channel is left, cancelling the handler
+// does not interrupt NextPeerEvent.
+func (n *Node) pullPeerEvents(ctx context.Context, descr string, handler *pubsub.TopicEventHandler) {
+	for {
+		ev, err := handler.NextPeerEvent(ctx)
+		if err != nil {
+			// Handler is cancelled on leave or the node is closed.
+			return
+		}
+
+		n.events.publish(ChannelPeerEvent{
+			Channel: descr,
+			Peer:    ev.Peer,
+			Joined:  ev.Type == pubsub.PeerJoin,
+		})
+		if ev.Type == pubsub.PeerJoin {
+			// There might be messages waiting for peers to appear.
+			n.outbox.wakeup()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package infchat
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestEventBusOverflow(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   OverflowPolicy
+		buffer   int
+		publish  int
+		received []string
+		dropped  uint64
+	}{
+		{
+			name:     "no overflow",
+			policy:   DropOldest,
+			buffer:   3,
+			publish:  3,
+			received: []string{"0", "1", "2"},
+		},
+		{
+			name:     "drop oldest",
+			policy:   DropOldest,
+			buffer:   3,
+			publish:  5,
+			received: []string{"2", "3", "4"},
+			dropped:  2,
+		},
+		{
+			name:     "drop newest",
+			policy:   DropNewest,
+			buffer:   3,
+			publish:  5,
+			received: []string{"0", "1", "2"},
+			dropped:  2,
+		},
+		{
+			name:     "drop oldest, buffer of one",
+			policy:   DropOldest,
+			buffer:   1,
+			publish:  3,
+			received: []string{"2"},
+			dropped:  2,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			n := &Node{events: newEventBus()}
+			sub, err := n.Subscribe(EventFilter{BufferSize: c.buffer, Overflow: c.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < c.publish; i++ {
+				n.events.publish(ChannelPeerEvent{Channel: strconv.Itoa(i), Joined: true})
+			}
+			n.events.close()
+
+			var received []string
+			for ev := range sub.Events() {
+				received = append(received, ev.(ChannelPeerEvent).Channel)
+			}
+			if len(received) != len(c.received) {
+				t.Fatalf("wrong events: want %v, got %v", c.received, received)
+			}
+			for i := range received {
+				if received[i] != c.received[i] {
+					t.Fatalf("wrong events: want %v, got %v", c.received, received)
+				}
+			}
+			if sub.Dropped() != c.dropped {
+				t.Errorf("wrong dropped count: want %d, got %d", c.dropped, sub.Dropped())
+			}
+		})
+	}
+}
+
+func TestEventBusFilter(t *testing.T) {
+	n := &Node{events: newEventBus()}
+	sub, err := n.Subscribe(EventFilter{
+		Types:    []EventType{EventMessage, EventReachability},
+		Channels: []string{"#a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n.events.publish(MessageEvent{Message{ID: "1", Channel: "#a"}})
+	n.events.publish(MessageEvent{Message{ID: "2", Channel: "#b"}})
+	n.events.publish(ChannelPeerEvent{Channel: "#a"})
+	n.events.publish(ReachabilityEvent{})
+	n.events.close()
+
+	var got []EventType
+	for ev := range sub.Events() {
+		got = append(got, ev.Type())
+		if ev, ok := ev.(MessageEvent); ok && ev.ID != "1" {
+			t.Errorf("unexpected message %s", ev.ID)
+		}
+	}
+	if len(got) != 2 || got[0] != EventMessage || got[1] != EventReachability {
+		t.Errorf("wrong events: %v", got)
+	}
+
+	if _, err := n.Subscribe(EventFilter{}); err != ErrClosed {
+		t.Errorf("expected ErrClosed after close, got %v", err)
+	}
+}
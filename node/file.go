@@ -0,0 +1,513 @@
+package infchat
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// FileProtocol is the stream protocol used to download offered files.
+//
+// Files are offered by posting KindFile messages. Requester sends
+// a JSON-encoded fileRequest terminated by a newline, responder replies with
+// a JSON-encoded fileResponse terminated by a newline followed by the file
+// contents starting at the requested offset and closes the stream.
+//
+// Offers are kept only in memory, so files are no longer available after the
+// offering node restarts.
+const FileProtocol protocol.ID = "/infinitychat/v0.1/file"
+
+const (
+	fileChunkSize = 64 * 1024
+
+	// Each chunk should be transferred within that time.
+	fileChunkTimeout = 30 * time.Second
+
+	// How often the download progress is reported.
+	fileProgressInterval = time.Second
+)
+
+var (
+	ErrNotFileOffer        = errors.New("message is not a file offer")
+	ErrNoDownloadDir       = errors.New("download directory is not configured")
+	ErrHashMismatch        = errors.New("downloaded file does not match the offer")
+	ErrInvalidFileName     = errors.New("invalid file name")
+	ErrTransferInterrupted = errors.New("transfer interrupted")
+	ErrNoSources           = errors.New("no peers to download from")
+	ErrDownloadInProgress  = errors.New("file is already being downloaded")
+)
+
+// FileInfo describes the offered file.
+type FileInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Hex-encoded SHA-256 of the file contents.
+	Hash string `json:"sha256"`
+}
+
+type fileOffer struct {
+	Path    string
+	Info    FileInfo
+	Channel string
+}
+
+type fileRequest struct {
+	Hash   string `json:"sha256"`
+	Offset int64  `json:"offset"`
+}
+
+type fileResponse struct {
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func hashFile(path string) (FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !st.Mode().IsRegular() {
+		return FileInfo{}, errors.New("not a regular file")
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	// Leading dots would make the name invalid for checkFileInfo, so
+	// .bashrc is sent as bashrc.
+	return FileInfo{
+		Name: strings.TrimLeft(filepath.Base(path), "."),
+		Size: size,
+		Hash: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// OfferFile announces the file to the channel or peer referenced by the
+// descriptor. Channel members (or the peer) can download it until the node
+// is closed.
+func (n *Node) OfferFile(descr, path string) (*Delivery, error) {
+	info, err := hashFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("offer: %w", err)
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("offer: %w", err)
+	}
+
+	d, err := n.PostMessage(descr, Message{
+		Kind: KindFile,
+		Text: fmt.Sprintf("%s (%d bytes)", info.Name, info.Size),
+		File: &info,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n.filesLock.Lock()
+	n.fileOffers[info.Hash] = append(n.fileOffers[info.Hash], &fileOffer{
+		Path:    path,
+		Info:    info,
+		Channel: descr,
+	})
+	n.filesLock.Unlock()
+
+	return d, nil
+}
+
+// findOffer returns our offer of the file with the specified hash if it was
+// made to the channel the remote peer is a member of or to the peer itself.
+func (n *Node) findOffer(hash string, remote peer.ID) *fileOffer {
+	n.filesLock.Lock()
+	offers := n.fileOffers[hash]
+	n.filesLock.Unlock()
+
+	for _, offer := range offers {
+		if strings.HasPrefix(offer.Channel, DMPrefix) {
+			if pid, err := DMPeer(offer.Channel); err == nil && pid == remote {
+				return offer
+			}
+			continue
+		}
+		for _, p := range n.PubsubProto.ListPeers(TopicName(offer.Channel)) {
+			if p == remote {
+				return offer
+			}
+		}
+	}
+	return nil
+}
+
+func (n *Node) handleFileStream(s network.Stream) {
+	n.serveTransfer(s, func(req fileRequest, remote peer.ID) (string, int64, error) {
+		offer := n.findOffer(req.Hash, remote)
+		if offer == nil {
+			n.Cfg.Log.Printf("File request from %v refused: no such offer", remote)
+			return "", 0, errors.New("no such file")
+		}
+		return offer.Path, offer.Info.Size, nil
+	})
+}
+
+// serveTransfer implements the responder side of FileProtocol and
+// BlobProtocol. lookup returns the path and the expected size of the
+// requested file, the error is sent to the requester.
+func (n *Node) serveTransfer(s network.Stream, lookup func(req fileRequest, remote peer.ID) (string, int64, error)) {
+	defer s.Close()
+
+	remote := s.Conn().RemotePeer()
+
+	s.SetReadDeadline(time.Now().Add(15 * time.Second))
+	line, err := bufio.NewReader(io.LimitReader(s, 4096)).ReadBytes('\n')
+	if err != nil {
+		s.Reset()
+		return
+	}
+	var req fileRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		s.Reset()
+		return
+	}
+
+	reply := func(resp fileResponse) error {
+		s.SetWriteDeadline(time.Now().Add(fileChunkTimeout))
+		blob, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		_, err = s.Write(append(blob, '\n'))
+		return err
+	}
+
+	path, size, err := lookup(req, remote)
+	if err != nil {
+		reply(fileResponse{Error: err.Error()})
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		n.Cfg.Log.Printf("File request from %v: %v", remote, err)
+		reply(fileResponse{Error: "file is no longer available"})
+		return
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.Size() != size {
+		reply(fileResponse{Error: "file is no longer available"})
+		return
+	}
+	if req.Offset < 0 || req.Offset > size {
+		reply(fileResponse{Error: "invalid offset"})
+		return
+	}
+	if _, err := f.Seek(req.Offset, io.SeekStart); err != nil {
+		reply(fileResponse{Error: "file is no longer available"})
+		return
+	}
+
+	if err := reply(fileResponse{Size: size}); err != nil {
+		s.Reset()
+		return
+	}
+
+	buf := make([]byte, fileChunkSize)
+	for {
+		nr, err := f.Read(buf)
+		if nr > 0 {
+			s.SetWriteDeadline(time.Now().Add(fileChunkTimeout))
+			if _, err := s.Write(buf[:nr]); err != nil {
+				s.Reset()
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			n.Cfg.Log.Printf("File request from %v: %v", remote, err)
+			s.Reset()
+			return
+		}
+	}
+}
+
+// FileOffer returns the file offered by the message in the channel or
+// direct conversation referenced by the descriptor and the peer offering it.
+func (n *Node) FileOffer(descr, msgID string) (FileInfo, peer.ID, error) {
+	if rm, ok := n.recent.get(msgID); ok && rm.Channel == descr {
+		if rm.File == nil {
+			return FileInfo{}, "", ErrNotFileOffer
+		}
+		return *rm.File, rm.Sender, nil
+	}
+	if n.history == nil {
+		return FileInfo{}, "", ErrUnknownMessage
+	}
+
+	msgs, err := n.history.Query(descr, HistoryQuery{})
+	if err != nil {
+		return FileInfo{}, "", err
+	}
+	for _, msg := range msgs {
+		if msg.ID != msgID {
+			continue
+		}
+		if msg.File == nil || msg.Unverified {
+			return FileInfo{}, "", ErrNotFileOffer
+		}
+		return *msg.File, msg.Sender, nil
+	}
+	return FileInfo{}, "", ErrUnknownMessage
+}
+
+func checkFileInfo(info FileInfo) error {
+	if info.Size < 0 || len(info.Hash) != sha256.Size*2 {
+		return ErrNotFileOffer
+	}
+	if _, err := hex.DecodeString(info.Hash); err != nil {
+		return ErrNotFileOffer
+	}
+	// Names starting with a dot are rejected: the attachment store keeps
+	// its own files (like .part) under such names and skips them when
+	// looking up blobs.
+	name := info.Name
+	if name == "" || strings.HasPrefix(name, ".") || name != filepath.Base(name) ||
+		strings.ContainsAny(name, `/\`) {
+		return ErrInvalidFileName
+	}
+	return nil
+}
+
+// freePath returns the path in dir for the file that does not exist yet.
+func freePath(dir, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, base+" ("+strconv.Itoa(i)+")"+ext)
+	}
+}
+
+// DownloadFile downloads the file offered by the message and saves it to
+// Cfg.DownloadDir. It returns the path of the saved file.
+//
+// Partially downloaded data is kept, so interrupted download continues from
+// where it stopped if DownloadFile is called again for the same offer. The
+// file is saved only if its hash matches the offer.
+//
+// Only one download of the file can be in progress at a time, others fail
+// with ErrDownloadInProgress.
+//
+// progress, if not nil, is called periodically with the amount of bytes
+// downloaded so far.
+func (n *Node) DownloadFile(ctx context.Context, descr, msgID string, progress func(done, total int64)) (string, error) {
+	if n.Cfg.DownloadDir == "" {
+		return "", ErrNoDownloadDir
+	}
+	info, sender, err := n.FileOffer(descr, msgID)
+	if err != nil {
+		return "", err
+	}
+	if err := checkFileInfo(info); err != nil {
+		return "", err
+	}
+	if sender == n.ID() {
+		return "", errors.New("download: the file is offered by us")
+	}
+
+	if err := os.MkdirAll(n.Cfg.DownloadDir, 0700); err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	partPath := filepath.Join(n.Cfg.DownloadDir, info.Hash+".part")
+
+	n.filesLock.Lock()
+	if _, ok := n.downloads[partPath]; ok {
+		n.filesLock.Unlock()
+		return "", ErrDownloadInProgress
+	}
+	n.downloads[partPath] = struct{}{}
+	n.filesLock.Unlock()
+	defer func() {
+		n.filesLock.Lock()
+		delete(n.downloads, partPath)
+		n.filesLock.Unlock()
+	}()
+
+	if err := n.download(ctx, FileProtocol, []peer.ID{sender}, info, partPath, progress); err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+
+	path := freePath(n.Cfg.DownloadDir, info.Name)
+	if err := os.Rename(partPath, path); err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	return path, nil
+}
+
+// download fetches the file into partPath trying sources in order until the
+// file is complete. Data already in partPath is reused. The file is removed
+// if its hash does not match.
+func (n *Node) download(ctx context.Context, proto protocol.ID, sources []peer.ID, info FileInfo, partPath string, progress func(done, total int64)) error {
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Continue the previous download, if any.
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if offset > info.Size {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h.Reset()
+		offset = 0
+	}
+
+	err = ErrNoSources
+	for _, pid := range sources {
+		if offset == info.Size {
+			break
+		}
+		if pid == n.ID() {
+			continue
+		}
+		err = n.fetchFile(ctx, pid, proto, info, offset, f, h, progress)
+		if err == nil {
+			offset = info.Size
+			break
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		n.Cfg.Log.Printf("Download of %s from %v failed: %v", info.Hash, pid, err)
+
+		// Some data might be written before the failure.
+		offset, err = f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	}
+	if offset < info.Size {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != info.Hash {
+		f.Close()
+		os.Remove(partPath)
+		return ErrHashMismatch
+	}
+	return f.Close()
+}
+
+// fetchFile requests the file contents starting at offset and writes them to
+// both f and h.
+func (n *Node) fetchFile(ctx context.Context, pid peer.ID, proto protocol.ID, info FileInfo, offset int64, f io.Writer, h io.Writer, progress func(done, total int64)) error {
+	connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	s, err := n.Host.NewStream(connectCtx, pid, proto)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	blob, err := json.Marshal(fileRequest{Hash: info.Hash, Offset: offset})
+	if err != nil {
+		return err
+	}
+	s.SetWriteDeadline(time.Now().Add(15 * time.Second))
+	if _, err := s.Write(append(blob, '\n')); err != nil {
+		s.Reset()
+		return err
+	}
+
+	r := bufio.NewReaderSize(s, fileChunkSize)
+	s.SetReadDeadline(time.Now().Add(fileChunkTimeout))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	var resp fileResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		s.Reset()
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if resp.Size != info.Size {
+		s.Reset()
+		return ErrHashMismatch
+	}
+
+	w := io.MultiWriter(f, h)
+	buf := make([]byte, fileChunkSize)
+	done := offset
+	lastReport := time.Time{}
+	for done < info.Size {
+		if err := ctx.Err(); err != nil {
+			s.Reset()
+			return err
+		}
+
+		s.SetReadDeadline(time.Now().Add(fileChunkTimeout))
+		toRead := buf
+		if left := info.Size - done; left < int64(len(buf)) {
+			toRead = buf[:left]
+		}
+		nr, err := r.Read(toRead)
+		if nr > 0 {
+			if _, err := w.Write(toRead[:nr]); err != nil {
+				s.Reset()
+				return err
+			}
+			done += int64(nr)
+		}
+		if progress != nil && (time.Since(lastReport) >= fileProgressInterval || done == info.Size) {
+			progress(done, info.Size)
+			lastReport = time.Now()
+		}
+		if err == io.EOF && done < info.Size {
+			return ErrTransferInterrupted
+		}
+		if err != nil && err != io.EOF {
+			s.Reset()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package infchat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckFileInfo(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+
+	cases := []struct {
+		name string
+		fail bool
+	}{
+		{name: "photo.png"},
+		{name: "notes.txt.part"},
+		{name: "", fail: true},
+		{name: ".", fail: true},
+		{name: "..", fail: true},
+		{name: ".bashrc", fail: true},
+		{name: ".part", fail: true},
+		{name: "dir/file", fail: true},
+		{name: `dir\file`, fail: true},
+	}
+
+	for _, c := range cases {
+		err := checkFileInfo(FileInfo{Name: c.name, Size: 1, Hash: hash})
+		if c.fail && err == nil {
+			t.Errorf("%q: expected an error", c.name)
+		}
+		if !c.fail && err != nil {
+			t.Errorf("%q: unexpected error: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package infchat
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var ErrNoHistory = errors.New("history: message history is disabled")
+
+// historyRecord is the on-disk representation of Message.
+type historyRecord struct {
+	ID          string             `json:"id"`
+	Sender      string             `json:"sender"`
+	Timestamp   time.Time          `json:"ts"`
+	Received    time.Time          `json:"received"`
+	Kind        MessageKind        `json:"kind"`
+	Text        string             `json:"text"`
+	ReplyTo     string             `json:"reply_to,omitempty"`
+	Target      string             `json:"target,omitempty"`
+	File        *FileInfo          `json:"file,omitempty"`
+	Attachments []FileInfo         `json:"attachments,omitempty"`
+	Meta        *channelMetaRecord `json:"meta,omitempty"`
+	Extensions  map[string]string  `json:"ext,omitempty"`
+	Edited      bool               `json:"edited,omitempty"`
+	RelayedBy   string             `json:"relayed_by,omitempty"`
+	Legacy      bool               `json:"legacy,omitempty"`
+	// Pubsub message including the sender signature, missing for messages
+	// we sent and for ones saved by older versions.
+	Signed []byte `json:"signed,omitempty"`
+}
+
+// historyStore is a dumb message store that keeps an append-only log of
+// JSON-encoded messages per channel.
+//
+// Each query reads the whole log, this is fine for the amounts of data
+// a chat client accumulates. Senders of messages are also indexed in memory
+// since they are looked up for each received message, see Sender.
+type historyStore struct {
+	dir string
+
+	lock sync.Mutex
+	// Message senders by message ID, by channel. Channel index is loaded
+	// from the log on the first lookup and then updated by Add.
+	senders map[string]map[string]peer.ID
+}
+
+func openHistory(dir string) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	return &historyStore{
+		dir:     dir,
+		senders: map[string]map[string]peer.ID{},
+	}, nil
+}
+
+// indexSender adds the message to the sender index. The first message with
+// the ID wins, changes and unverified messages are not indexed.
+func indexSender(index map[string]peer.ID, msg Message) {
+	if changesMessage(msg.Kind) || msg.Unverified {
+		return
+	}
+	if _, ok := index[msg.ID]; ok {
+		return
+	}
+	index[msg.ID] = msg.Sender
+}
+
+// Sender returns the sender of the message with the specified ID.
+func (s *historyStore) Sender(descr, id string) (peer.ID, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	index, ok := s.senders[descr]
+	if !ok {
+		msgs, err := s.loadLocked(descr)
+		if err != nil {
+			return "", false, err
+		}
+		index = make(map[string]peer.ID, len(msgs))
+		for _, msg := range msgs {
+			indexSender(index, msg)
+		}
+		s.senders[descr] = index
+	}
+
+	sender, ok := index[id]
+	return sender, ok, nil
+}
+
+func (s *historyStore) logPath(descr string) string {
+	// Use topic name so private channel keys will not end up in file names.
+	return filepath.Join(s.dir, url.PathEscape(TopicName(descr))+".log")
+}
+
+func (s *historyStore) Add(msg Message) error {
+	var relayedBy string
+	if msg.RelayedBy != "" {
+		relayedBy = peer.Encode(msg.RelayedBy)
+	}
+
+	rec, err := json.Marshal(historyRecord{
+		ID:          msg.ID,
+		Sender:      peer.Encode(msg.Sender),
+		Timestamp:   msg.Timestamp,
+		Received:    time.Now(),
+		Kind:        msg.Kind,
+		Text:        msg.Text,
+		ReplyTo:     msg.ReplyTo,
+		Target:      msg.Target,
+		File:        msg.File,
+		Attachments: msg.Attachments,
+		Meta:        msg.meta,
+		Extensions:  msg.Extensions,
+		Edited:      msg.Edited,
+		RelayedBy:   relayedBy,
+		Legacy:      msg.Legacy,
+		Signed:      msg.signed,
+	})
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	rec = append(rec, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.OpenFile(s.logPath(msg.Channel), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(rec); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+
+	if index, ok := s.senders[msg.Channel]; ok {
+		indexSender(index, msg)
+	}
+	return nil
+}
+
+// load reads all messages logged for the channel, in the order they were
+// added.
+func (s *historyStore) load(descr string) ([]Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.loadLocked(descr)
+}
+
+func (s *historyStore) loadLocked(descr string) ([]Message, error) {
+	f, err := os.Open(s.logPath(descr))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	defer f.Close()
+
+	var msgs []Message
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), 4*MaxDMSize)
+	for scanner.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Most likely a partially written record, skip it.
+			continue
+		}
+		sender, err := peer.Decode(rec.Sender)
+		if err != nil {
+			continue
+		}
+		var relayedBy peer.ID
+		if rec.RelayedBy != "" {
+			relayedBy, _ = peer.Decode(rec.RelayedBy)
+		}
+
+		msgs = append(msgs, Message{
+			ID:          rec.ID,
+			Sender:      sender,
+			Channel:     descr,
+			Timestamp:   rec.Timestamp,
+			Kind:        rec.Kind,
+			Text:        rec.Text,
+			ReplyTo:     rec.ReplyTo,
+			Target:      rec.Target,
+			File:        rec.File,
+			Attachments: rec.Attachments,
+			meta:        rec.Meta,
+			Extensions:  rec.Extensions,
+			Edited:      rec.Edited,
+			RelayedBy:   relayedBy,
+			Unverified:  relayedBy != "" && len(rec.Signed) == 0,
+			Legacy:      rec.Legacy,
+			signed:      rec.Signed,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+
+	return msgs, nil
+}
+
+// HistoryQuery specifies which messages should be returned by Node.History.
+type HistoryQuery struct {
+	// Return only messages sent after (inclusive) Since. Zero value means no
+	// limit.
+	Since time.Time
+	// Return only messages sent before (exclusive) Until. Zero value means no
+	// limit.
+	Until time.Time
+
+	// Return at most Limit most recent messages. Zero means no limit.
+	Limit int
+	// Skip Offset most recent messages before applying Limit. Can be used to
+	// page through the history.
+	Offset int
+
+	// Return KindEdit, KindDelete and KindReaction messages as is instead of
+	// applying them to the messages they reference.
+	IncludeEdits bool
+}
+
+// applyEdits applies KindEdit, KindDelete and KindReaction messages to the
+// messages they reference and removes them from the list.
+//
+// Edits and deletions not sent by the author of the original message are
+// ignored. Unverified changes are ignored too since anybody could have
+// sent them.
+func applyEdits(msgs []Message) []Message {
+	byID := make(map[string]int, len(msgs))
+	deleted := map[string]bool{}
+	reacted := map[string]map[peer.ID]bool{}
+
+	res := msgs[:0]
+	for _, msg := range msgs {
+		if !changesMessage(msg.Kind) {
+			byID[msg.ID] = len(res)
+			res = append(res, msg)
+			continue
+		}
+
+		i, ok := byID[msg.Target]
+		if !ok || msg.Unverified {
+			continue
+		}
+		if msg.Kind == KindReaction {
+			key := msg.Target + " " + msg.Text
+			if reacted[key] == nil {
+				reacted[key] = map[peer.ID]bool{}
+			}
+			if reacted[key][msg.Sender] {
+				continue
+			}
+			reacted[key][msg.Sender] = true
+
+			if res[i].Reactions == nil {
+				res[i].Reactions = map[string]int{}
+			}
+			res[i].Reactions[msg.Text]++
+			continue
+		}
+		if res[i].Sender != msg.Sender {
+			continue
+		}
+		if msg.Kind == KindDelete {
+			deleted[msg.Target] = true
+			continue
+		}
+		res[i].Text = msg.Text
+		res[i].Edited = true
+	}
+
+	if len(deleted) == 0 {
+		return res
+	}
+	filtered := res[:0]
+	for _, msg := range res {
+		if !deleted[msg.ID] {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+func (s *historyStore) Query(descr string, q HistoryQuery) ([]Message, error) {
+	msgs, err := s.load(descr)
+	if err != nil {
+		return nil, err
+	}
+	if !q.IncludeEdits {
+		msgs = applyEdits(msgs)
+	}
+
+	filtered := msgs[:0]
+	for _, msg := range msgs {
+		if !q.Since.IsZero() && msg.Timestamp.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !msg.Timestamp.Before(q.Until) {
+			continue
+		}
+		filtered = append(filtered, msg)
+	}
+
+	end := len(filtered) - q.Offset
+	if end < 0 {
+		end = 0
+	}
+	start := 0
+	if q.Limit != 0 && end-q.Limit > 0 {
+		start = end - q.Limit
+	}
+
+	return filtered[start:end], nil
+}
+
+// History returns messages previously sent and received in the channel or
+// direct conversation referenced by the descriptor.
+//
+// Messages are returned in the order they were received.
+func (n *Node) History(descr string, q HistoryQuery) ([]Message, error) {
+	if n.history == nil {
+		return nil, ErrNoHistory
+	}
+	return n.history.Query(descr, q)
+}
+
+// seenMessages is a bounded set of recently delivered message IDs.
+type seenMessages struct {
+	lock sync.Mutex
+	// Ring buffer, next points to the oldest entry once it is full.
+	ring []string
+	next int
+	ids  map[string]struct{}
+}
+
+func newSeenMessages() *seenMessages {
+	return &seenMessages{
+		ring: make([]string, 0, recentMessagesSize),
+		ids:  make(map[string]struct{}, recentMessagesSize),
+	}
+}
+
+func (s *seenMessages) has(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// add adds the ID to the set. False is returned if it is already there.
+func (s *seenMessages) add(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, id)
+	} else {
+		delete(s.ids, s.ring[s.next])
+		s.ring[s.next] = id
+		s.next = (s.next + 1) % len(s.ring)
+	}
+	s.ids[id] = struct{}{}
+	return true
+}
+
+// deliver records the incoming message in the local history and passes it
+// to the subscribers.
+//
+// The same message can be received several times, e.g. via pubsub and
+// history sync, only the first copy is delivered.
+func (n *Node) deliver(msg Message) {
+	if msg.Kind == KindTyping {
+		state := TypingState(msg.Text)
+		if msg.RelayedBy == "" && checkTyping(state) == nil {
+			n.events.publish(TypingEvent{Channel: msg.Channel, Peer: msg.Sender, State: state})
+		}
+		return
+	}
+	if n.seen.has(msg.ID) {
+		return
+	}
+
+	switch msg.Kind {
+	case KindEdit, KindDelete:
+		if !n.checkEdit(msg) {
+			return
+		}
+	case KindReaction:
+		if !n.checkReaction(msg) {
+			return
+		}
+	case KindTopic:
+		// The record is signed, so it can be accepted from history sync
+		// too.
+		if !strings.HasPrefix(msg.Channel, ChanPrefix) || msg.meta == nil || msg.meta.Author != peer.Encode(msg.Sender) {
+			return
+		}
+		if err := n.applyChannelMeta(msg.Channel, *msg.meta); err != nil {
+			n.Cfg.Log.Printf("Invalid channel meta from %v: %v", msg.Sender, err)
+			return
+		}
+	default:
+		// Otherwise anybody could take over the message (and edit it) by
+		// sending another one with the same ID.
+		if sender, ok := n.lookupSender(msg.Channel, msg.ID); ok && sender != msg.Sender {
+			n.Cfg.Log.Printf("Ignoring message %s from %v: ID is used by %v", msg.ID, msg.Sender, sender)
+			return
+		}
+		n.recent.add(msg)
+	}
+
+	// Checks above are not atomic, so the copy received concurrently might
+	// have been delivered already.
+	if !n.seen.add(msg.ID) {
+		return
+	}
+
+	n.recordHistory(msg)
+
+	if msg.RelayedBy == "" {
+		n.refreshProfile(msg.Sender)
+	}
+
+	n.events.publish(MessageEvent{msg})
+}
+
+func (n *Node) recordHistory(msg Message) {
+	if n.history == nil {
+		return
+	}
+	if err := n.history.Add(msg); err != nil {
+		n.Cfg.Log.Printf("Failed to save message: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package infchat
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// testPeer generates a new key pair and returns it with the peer ID.
+func testPeer(t *testing.T) (crypto.PrivKey, peer.ID) {
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pid
+}
+
+func TestApplyEdits(t *testing.T) {
+	const (
+		alice = peer.ID("alice")
+		bob   = peer.ID("bob")
+	)
+	text := func(id string, sender peer.ID, text string) Message {
+		return Message{ID: id, Sender: sender, Kind: KindText, Text: text}
+	}
+	change := func(kind MessageKind, sender peer.ID, target, text string) Message {
+		return Message{ID: "change-" + target + "-" + text, Sender: sender, Kind: kind, Target: target, Text: text}
+	}
+	relayed := func(msg Message) Message {
+		msg.RelayedBy = bob
+		return msg
+	}
+	unverified := func(msg Message) Message {
+		msg.RelayedBy = bob
+		msg.Unverified = true
+		return msg
+	}
+
+	type result struct {
+		id     string
+		text   string
+		edited bool
+	}
+	cases := []struct {
+		name string
+		msgs []Message
+		want []result
+	}{
+		{
+			name: "edit by author",
+			msgs: []Message{
+				text("1", alice, "helo"),
+				change(KindEdit, alice, "1", "hello"),
+			},
+			want: []result{{"1", "hello", true}},
+		},
+		{
+			name: "last edit wins",
+			msgs: []Message{
+				text("1", alice, "a"),
+				change(KindEdit, alice, "1", "b"),
+				change(KindEdit, alice, "1", "c"),
+			},
+			want: []result{{"1", "c", true}},
+		},
+		{
+			name: "edit by somebody else",
+			msgs: []Message{
+				text("1", alice, "hello"),
+				change(KindEdit, bob, "1", "pwned"),
+			},
+			want: []result{{"1", "hello", false}},
+		},
+		{
+			name: "relayed edit",
+			msgs: []Message{
+				text("1", alice, "helo"),
+				relayed(change(KindEdit, alice, "1", "hello")),
+			},
+			want: []result{{"1", "hello", true}},
+		},
+		{
+			name: "unverified edit",
+			msgs: []Message{
+				text("1", alice, "hello"),
+				unverified(change(KindEdit, alice, "1", "pwned")),
+			},
+			want: []result{{"1", "hello", false}},
+		},
+		{
+			name: "edit before the message",
+			msgs: []Message{
+				change(KindEdit, alice, "1", "early"),
+				text("1", alice, "hello"),
+			},
+			want: []result{{"1", "hello", false}},
+		},
+		{
+			name: "delete by author",
+			msgs: []Message{
+				text("1", alice, "hello"),
+				text("2", bob, "hi"),
+				change(KindDelete, alice, "1", ""),
+			},
+			want: []result{{"2", "hi", false}},
+		},
+		{
+			name: "delete by somebody else",
+			msgs: []Message{
+				text("1", alice, "hello"),
+				change(KindDelete, bob, "1", ""),
+			},
+			want: []result{{"1", "hello", false}},
+		},
+		{
+			name: "unverified delete",
+			msgs: []Message{
+				text("1", alice, "hello"),
+				unverified(change(KindDelete, alice, "1", "")),
+			},
+			want: []result{{"1", "hello", false}},
+		},
+		{
+			name: "edit after delete",
+			msgs: []Message{
+				text("1", alice, "hello"),
+				change(KindDelete, alice, "1", ""),
+				change(KindEdit, alice, "1", "back"),
+			},
+			want: nil,
+		},
+		{
+			name: "delete before the message",
+			msgs: []Message{
+				change(KindDelete, alice, "1", ""),
+				text("1", alice, "hello"),
+			},
+			want: []result{{"1", "hello", false}},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			got := applyEdits(c.msgs)
+			if len(got) != len(c.want) {
+				t.Fatalf("wrong amount of messages: want %d, got %d (%+v)", len(c.want), len(got), got)
+			}
+			for i, w := range c.want {
+				if got[i].ID != w.id || got[i].Text != w.text || got[i].Edited != w.edited {
+					t.Errorf("message %d: want %+v, got ID %s, text %q, edited %v",
+						i, w, got[i].ID, got[i].Text, got[i].Edited)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyEditsReactions(t *testing.T) {
+	const (
+		alice = peer.ID("alice")
+		bob   = peer.ID("bob")
+	)
+	msgs := []Message{
+		{ID: "r0", Sender: bob, Kind: KindReaction, Target: "1", Text: "+1"},
+		{ID: "1", Sender: alice, Kind: KindText, Text: "hello"},
+		{ID: "r1", Sender: bob, Kind: KindReaction, Target: "1", Text: "+1"},
+		{ID: "r2", Sender: bob, Kind: KindReaction, Target: "1", Text: "+1"},
+		{ID: "r3", Sender: alice, Kind: KindReaction, Target: "1", Text: "+1"},
+		{ID: "r4", Sender: alice, Kind: KindReaction, Target: "1", Text: "heart"},
+		{ID: "r5", Sender: alice, Kind: KindReaction, Target: "1", Text: "party", RelayedBy: bob, Unverified: true},
+	}
+
+	got := applyEdits(msgs)
+	if len(got) != 1 {
+		t.Fatalf("wrong amount of messages: %d", len(got))
+	}
+	want := map[string]int{"+1": 2, "heart": 1}
+	if len(got[0].Reactions) != len(want) {
+		t.Fatalf("wrong reactions: want %v, got %v", want, got[0].Reactions)
+	}
+	for reaction, count := range want {
+		if got[0].Reactions[reaction] != count {
+			t.Errorf("wrong count for %s: want %d, got %d", reaction, count, got[0].Reactions[reaction])
+		}
+	}
+}
+
+func TestHistorySender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infchat-history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const descr = ChanPrefix + "test"
+	_, alice := testPeer(t)
+	_, bob := testPeer(t)
+
+	msg := func(id string, sender peer.ID, kind MessageKind) Message {
+		return Message{ID: id, Sender: sender, Channel: descr, Kind: kind, Timestamp: time.Now()}
+	}
+	unverified := msg("3", bob, KindText)
+	unverified.RelayedBy = alice
+	unverified.Unverified = true
+
+	check := func(s *historyStore, id string, want peer.ID) {
+		t.Helper()
+		sender, ok, err := s.Sender(descr, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == "" {
+			if ok {
+				t.Errorf("%s: unexpected sender %v", id, sender)
+			}
+			return
+		}
+		if !ok || sender != want {
+			t.Errorf("%s: wrong sender: want %v, got %v", id, want, sender)
+		}
+	}
+
+	s, err := openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Message{
+		msg("1", alice, KindText),
+		msg("1", bob, KindText),
+		msg("2", bob, KindEdit),
+		unverified,
+	} {
+		if err := s.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Index loaded from the log.
+	check(s, "1", alice)
+	check(s, "2", "")
+	check(s, "3", "")
+
+	// Index updated by Add.
+	if err := s.Add(msg("4", bob, KindText)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(msg("4", alice, KindText)); err != nil {
+		t.Fatal(err)
+	}
+	check(s, "4", bob)
+
+	// Same result after reopening.
+	s, err = openHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(s, "1", alice)
+	check(s, "3", "")
+	check(s, "4", bob)
+}
@@ -0,0 +1,405 @@
+package infchat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pubsub_pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+// HistorySyncProtocol is the request-response protocol used to fetch
+// messages sent to a channel before we joined it.
+//
+// Requester sends a single JSON-encoded historyRequest, responder replies
+// with a sequence of JSON-encoded historyItem objects and closes the stream.
+//
+// Items are pubsub messages as they were originally received, including the
+// signature of the sender, so the responder can not forge messages or change
+// their senders. Messages that can not be verified this way are not sent.
+const HistorySyncProtocol protocol.ID = "/infinitychat/v0.2/history"
+
+const (
+	// Maximum amount of messages we are going to send in response to
+	// a single request.
+	MaxHistorySyncMessages = 200
+
+	// How far back to look if we have no messages for the channel at all.
+	HistorySyncWindow = 24 * time.Hour
+
+	// How many channel members to ask for history.
+	historySyncPeers = 3
+
+	// Maximum size of the response we are willing to read. Items are
+	// base64-encoded signed messages, hence the factor of 2.
+	maxHistorySyncResponse = MaxHistorySyncMessages * 2 * (MaxDMSize + 1024)
+)
+
+type historyRequest struct {
+	// Pubsub topic name, not the descriptor. Otherwise we would give away
+	// private channel keys.
+	Topic string `json:"topic"`
+	// Unix time in milliseconds.
+	Since   int64  `json:"since"`
+	AfterID string `json:"after_id,omitempty"`
+	Limit   int    `json:"limit"`
+}
+
+type historyItem struct {
+	// Serialized pubsub message (pubsub_pb.Message) with the signature.
+	Signed []byte `json:"signed"`
+}
+
+func (n *Node) handleHistoryStream(s network.Stream) {
+	defer s.Close()
+
+	remote := s.Conn().RemotePeer()
+
+	s.SetReadDeadline(time.Now().Add(15 * time.Second))
+	var req historyRequest
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&req); err != nil {
+		s.Reset()
+		return
+	}
+
+	if n.history == nil {
+		return
+	}
+	descr, ok := n.joinedByTopic(req.Topic)
+	if !ok {
+		return
+	}
+
+	// Do not give away history to anybody who just happens to know the
+	// channel name. We want to see the requester in the channel first.
+	isMember := false
+	for _, p := range n.PubsubProto.ListPeers(req.Topic) {
+		if p == remote {
+			isMember = true
+			break
+		}
+	}
+	if !isMember {
+		n.Cfg.Log.Printf("History request from %v for %s refused: not a member", remote, RedactDescriptor(descr))
+		return
+	}
+
+	// Edits are sent as is, the requester checks them the same way as the
+	// ones received directly.
+	msgs, err := n.history.Query(descr, HistoryQuery{IncludeEdits: true})
+	if err != nil {
+		n.Cfg.Log.Printf("History request from %v: %v", remote, err)
+		s.Reset()
+		return
+	}
+
+	afterIDFound := false
+	if req.AfterID != "" {
+		for i, msg := range msgs {
+			if msg.ID == req.AfterID {
+				msgs = msgs[i+1:]
+				afterIDFound = true
+				break
+			}
+		}
+	}
+	if !afterIDFound {
+		// Log is ordered by the time of arrival, not by the sender timestamp,
+		// so we cannot just binary search here.
+		since := time.Unix(0, req.Since*int64(time.Millisecond))
+		filtered := msgs[:0]
+		for _, msg := range msgs {
+			if !msg.Timestamp.Before(since) {
+				filtered = append(filtered, msg)
+			}
+		}
+		msgs = filtered
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > MaxHistorySyncMessages {
+		limit = MaxHistorySyncMessages
+	}
+	if len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+
+	s.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	enc := json.NewEncoder(s)
+	for _, msg := range msgs {
+		signed := msg.signed
+		if msg.Sender == n.ID() {
+			// We do not keep our own messages as they were sent, but we
+			// can sign them again.
+			signed, err = n.signChannelMessage(descr, msg)
+			if err != nil {
+				n.Cfg.Log.Printf("History request from %v: %v", remote, err)
+				continue
+			}
+		}
+		if len(signed) == 0 {
+			continue
+		}
+		if err := enc.Encode(historyItem{Signed: signed}); err != nil {
+			s.Reset()
+			return
+		}
+	}
+}
+
+// signChannelMessage creates the signed pubsub message with our message the
+// same way pubsub router does when the message is published.
+func (n *Node) signChannelMessage(descr string, msg Message) ([]byte, error) {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if IsPrivateChannel(descr) {
+		payload, err = sealPayload(descr, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seqno := make([]byte, 8)
+	if _, err := rand.Read(seqno); err != nil {
+		return nil, err
+	}
+	pm := pubsub_pb.Message{
+		From:     []byte(n.ID()),
+		Data:     payload,
+		Seqno:    seqno,
+		TopicIDs: []string{TopicName(descr)},
+	}
+	if err := signPubsubMessage(n.Host.Peerstore().PrivKey(n.ID()), &pm); err != nil {
+		return nil, err
+	}
+	return pm.Marshal()
+}
+
+func signPubsubMessage(key crypto.PrivKey, pm *pubsub_pb.Message) error {
+	unsigned, err := pm.Marshal()
+	if err != nil {
+		return err
+	}
+	pm.Signature, err = key.Sign(append([]byte(pubsub.SignPrefix), unsigned...))
+	if err != nil {
+		return err
+	}
+	if pk, _ := peer.ID(pm.From).ExtractPublicKey(); pk == nil {
+		pm.Key, err = key.GetPublic().Bytes()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChannelMessage checks the signature of the pubsub message relayed by
+// another member and decodes it.
+func verifyChannelMessage(descr string, signed []byte) (Message, error) {
+	var pm pubsub_pb.Message
+	if err := pm.Unmarshal(signed); err != nil {
+		return Message{}, err
+	}
+	if len(pm.TopicIDs) != 1 || pm.TopicIDs[0] != TopicName(descr) {
+		return Message{}, errors.New("message was sent to another topic")
+	}
+
+	sender, err := peer.IDFromBytes(pm.From)
+	if err != nil {
+		return Message{}, err
+	}
+	var pubKey crypto.PubKey
+	if pm.Key == nil {
+		pubKey, err = sender.ExtractPublicKey()
+		if err != nil {
+			return Message{}, fmt.Errorf("no signing key: %w", err)
+		}
+	} else {
+		pubKey, err = crypto.UnmarshalPublicKey(pm.Key)
+		if err != nil {
+			return Message{}, fmt.Errorf("malformed signing key: %w", err)
+		}
+		if !sender.MatchesPublicKey(pubKey) {
+			return Message{}, errors.New("signing key does not match the sender")
+		}
+	}
+
+	unsigned := pm
+	unsigned.Signature = nil
+	unsigned.Key = nil
+	data, err := unsigned.Marshal()
+	if err != nil {
+		return Message{}, err
+	}
+	ok, err := pubKey.Verify(append([]byte(pubsub.SignPrefix), data...), pm.Signature)
+	if err != nil {
+		return Message{}, err
+	}
+	if !ok {
+		return Message{}, errors.New("invalid signature")
+	}
+
+	msg, err := decodeChannelMessage(descr, &pubsub.Message{Message: &pm})
+	if err != nil {
+		return Message{}, err
+	}
+	msg.signed = signed
+	return msg, nil
+}
+
+func (n *Node) requestHistory(ctx context.Context, pid peer.ID, descr string, req historyRequest) ([]Message, error) {
+	s, err := n.Host.NewStream(ctx, pid, HistorySyncProtocol)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	s.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := json.NewEncoder(s).Encode(req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	var msgs []Message
+	dec := json.NewDecoder(io.LimitReader(s, maxHistorySyncResponse))
+	for len(msgs) < MaxHistorySyncMessages {
+		var item historyItem
+		if err := dec.Decode(&item); err != nil {
+			if err == io.EOF {
+				break
+			}
+			s.Reset()
+			return msgs, err
+		}
+
+		msg, err := verifyChannelMessage(descr, item.Signed)
+		if err != nil {
+			n.Cfg.Log.Printf("Dropping message relayed by %v: %v", pid, err)
+			continue
+		}
+		if msg.Sender == n.ID() || msg.Kind == KindTyping {
+			continue
+		}
+		msg.RelayedBy = pid
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// SyncHistory asks connected members of the channel for messages sent since
+// the last message we have in the local history.
+//
+// Messages not seen before are saved and delivered via Node.Messages in the
+// order of their timestamps.
+func (n *Node) SyncHistory(descr string) error {
+	if n.history == nil {
+		return ErrNoHistory
+	}
+
+	local, err := n.history.Query(descr, HistoryQuery{IncludeEdits: true})
+	if err != nil {
+		return fmt.Errorf("history sync: %w", err)
+	}
+	req := historyRequest{
+		Topic: TopicName(descr),
+		Since: time.Now().Add(-HistorySyncWindow).UnixNano() / int64(time.Millisecond),
+		Limit: MaxHistorySyncMessages,
+	}
+	if len(local) != 0 {
+		last := local[len(local)-1]
+		req.AfterID = last.ID
+		// Clocks are not perfectly in sync, so leave some margin. Duplicates
+		// will be filtered out anyway.
+		req.Since = last.Timestamp.Add(-5*time.Minute).UnixNano() / int64(time.Millisecond)
+	}
+
+	members := n.ConnectedMembers(descr)
+	if len(members) == 0 {
+		return errors.New("history sync: no connected channel members")
+	}
+	if len(members) > historySyncPeers {
+		members = members[:historySyncPeers]
+	}
+
+	ctx, cancel := context.WithTimeout(n.nodeContext, time.Minute)
+	defer cancel()
+
+	var fetched []Message
+	for _, p := range members {
+		msgs, err := n.requestHistory(ctx, p, descr, req)
+		if err != nil {
+			n.Cfg.Log.Printf("History sync with %v failed: %v", p, err)
+		}
+		fetched = append(fetched, msgs...)
+	}
+
+	// Re-read the local history, we might have received some messages
+	// via pubsub in the meantime.
+	local, err = n.history.Query(descr, HistoryQuery{IncludeEdits: true})
+	if err != nil {
+		return fmt.Errorf("history sync: %w", err)
+	}
+	seen := make(map[string]struct{}, len(local)+len(fetched))
+	for _, msg := range local {
+		seen[msg.ID] = struct{}{}
+	}
+
+	sort.SliceStable(fetched, func(i, j int) bool {
+		return fetched[i].Timestamp.Before(fetched[j].Timestamp)
+	})
+	for _, msg := range fetched {
+		if _, ok := seen[msg.ID]; ok {
+			continue
+		}
+		seen[msg.ID] = struct{}{}
+
+		n.deliver(msg)
+	}
+
+	return nil
+}
+
+// syncHistoryOnJoin waits for the channel members to appear and then
+// performs history sync.
+func (n *Node) syncHistoryOnJoin(descr string) {
+	if n.history == nil {
+		return
+	}
+
+	t := time.NewTicker(2 * time.Second)
+	defer t.Stop()
+	deadline := time.Now().Add(time.Minute)
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-t.C:
+		case <-n.nodeContext.Done():
+			return
+		}
+
+		if !n.IsJoined(descr) {
+			return
+		}
+		if len(n.ConnectedMembers(descr)) == 0 {
+			continue
+		}
+
+		if err := n.SyncHistory(descr); err != nil {
+			n.Cfg.Log.Printf("%v", err)
+		}
+		return
+	}
+}
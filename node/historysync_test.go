@@ -0,0 +1,90 @@
+package infchat
+
+import (
+	"testing"
+	"time"
+
+	pubsub_pb "github.com/libp2p/go-libp2p-pubsub/pb"
+)
+
+func TestVerifyChannelMessage(t *testing.T) {
+	const descr = ChanPrefix + "test"
+
+	aliceKey, alice := testPeer(t)
+	_, bob := testPeer(t)
+
+	payload, err := encodeMessage(Message{ID: "abc", Kind: KindText, Text: "hi", Timestamp: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(change func(pm *pubsub_pb.Message)) []byte {
+		pm := pubsub_pb.Message{
+			From:     []byte(alice),
+			Data:     payload,
+			Seqno:    []byte{0, 0, 0, 0, 0, 0, 0, 1},
+			TopicIDs: []string{TopicName(descr)},
+		}
+		if err := signPubsubMessage(aliceKey, &pm); err != nil {
+			t.Fatal(err)
+		}
+		change(&pm)
+		b, err := pm.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	cases := []struct {
+		name   string
+		change func(pm *pubsub_pb.Message)
+		fail   bool
+	}{
+		{
+			name:   "valid",
+			change: func(pm *pubsub_pb.Message) {},
+		},
+		{
+			name:   "changed text",
+			change: func(pm *pubsub_pb.Message) { pm.Data = append(pm.Data[:len(pm.Data):len(pm.Data)], 'x') },
+			fail:   true,
+		},
+		{
+			name:   "changed sender",
+			change: func(pm *pubsub_pb.Message) { pm.From = []byte(bob) },
+			fail:   true,
+		},
+		{
+			name:   "another topic",
+			change: func(pm *pubsub_pb.Message) { pm.TopicIDs = []string{TopicName(ChanPrefix + "other")} },
+			fail:   true,
+		},
+		{
+			name:   "no signature",
+			change: func(pm *pubsub_pb.Message) { pm.Signature = nil },
+			fail:   true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := verifyChannelMessage(descr, signed(c.change))
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if msg.Sender != alice || msg.ID != "abc" || msg.Text != "hi" {
+				t.Errorf("wrong message: %+v", msg)
+			}
+			if msg.signed == nil {
+				t.Error("signed message is not kept")
+			}
+		})
+	}
+}
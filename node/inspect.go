@@ -15,7 +15,7 @@ func (n *Node) IsJoined(chanDescr string) bool {
 }
 
 func (n *Node) ConnectedMembers(chanDescr string) []peer.ID {
-	members := n.PubsubProto.ListPeers(chanDescr)
+	members := n.PubsubProto.ListPeers(TopicName(chanDescr))
 
 	res := make([]peer.ID, 0, len(members))
 	for _, p := range members {
@@ -59,3 +59,16 @@ func (n *Node) Status() StatusData {
 
 	return s
 }
+
+// JoinedChannels returns descriptors of all channels we are currently a
+// member of, in no particular order.
+func (n *Node) JoinedChannels() []string {
+	n.pubsubLock.Lock()
+	defer n.pubsubLock.Unlock()
+
+	res := make([]string, 0, len(n.subs))
+	for descr := range n.subs {
+		res = append(res, descr)
+	}
+	return res
+}
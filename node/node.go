@@ -14,6 +14,7 @@ import (
 	autonat "github.com/libp2p/go-libp2p-autonat"
 	connmgr "github.com/libp2p/go-libp2p-connmgr"
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/event"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/pnet"
@@ -32,6 +33,7 @@ const AdvertiseTTL = 10 * time.Minute
 
 type Config struct {
 	Identity ed25519.PrivateKey
+	Nickname string
 
 	Bootstrap    []string
 	ListenAddrs  []string
@@ -46,6 +48,38 @@ type Config struct {
 	RejoinInterval   time.Duration
 	AnnounceInterval time.Duration
 
+	// How often to publish our presence record. DefaultPresenceInterval is
+	// used if it is zero.
+	PresenceInterval time.Duration
+
+	// Directory to store message history in. History is not saved if it is
+	// empty.
+	HistoryDir string
+
+	// File to store the local address book in. Address book is disabled if
+	// it is empty.
+	ContactsPath string
+
+	// File to save pending outgoing messages to. They are kept only in
+	// memory if it is empty.
+	OutboxPath string
+
+	// File to save known peers and DHT routing table to. They are used to
+	// reconnect to the network on the next start. Not saved if it is empty.
+	PeersPath string
+
+	// Directory to save downloaded files to. Downloads are disabled if it is
+	// empty.
+	DownloadDir string
+
+	// Directory to store attachments of sent and fetched messages in.
+	// Attachments can not be sent or fetched if it is empty.
+	AttachmentsDir string
+
+	// Announce attachments of public channel messages in the DHT so they
+	// can be fetched from us by peers that are not connected to the sender.
+	ProvideAttachments bool
+
 	Log *log.Logger
 }
 
@@ -70,8 +104,54 @@ type Node struct {
 	topics              map[string]*pubsub.Topic
 	subs                map[string]*pubsub.Subscription
 	knownChannelMembers map[string]int
+	// Stop functions for pullPeerEvents goroutines.
+	peerEventsStop map[string]func()
+
+	history *historyStore
+
+	profileLock    sync.Mutex
+	profile        profileRecord
+	profileFetched map[peer.ID]time.Time
+	// Peers with cached profiles, by nickname.
+	nickOwners map[string]map[peer.ID]struct{}
+
+	contactsLock sync.Mutex
+	contacts     *contactBook
+
+	presence presenceTracker
+
+	outbox *outbox
+
+	deliveriesLock sync.Mutex
+	deliveries     map[string]*Delivery
+
+	// Recently sent and received messages, used to check edits.
+	recent *recentMessages
+	// IDs of recently delivered messages of all kinds, used to drop
+	// duplicates.
+	seen *seenMessages
+
+	// Files we offered, by hash.
+	filesLock  sync.Mutex
+	fileOffers map[string][]*fileOffer
+	// Attachments being fetched or added, by hash. Channel is closed when
+	// the operation completes.
+	blobsBusy map[string]chan struct{}
+	// Partial files of downloads in progress.
+	downloads map[string]struct{}
+
+	// Channel metadata records, by descriptor.
+	metaLock    sync.Mutex
+	channelMeta map[string]knownMeta
+
+	// Last typing notification we sent, by descriptor.
+	typingLock sync.Mutex
+	typingSent map[string]typingSent
+
+	// Peers loaded from Cfg.PeersPath, dialed in Run.
+	savedPeers []peer.ID
 
-	messages chan Message
+	events *eventBus
 }
 
 func NewNode(cfg Config) (*Node, error) {
@@ -82,11 +162,26 @@ func NewNode(cfg Config) (*Node, error) {
 		Cfg:         cfg,
 		nodeContext: ctx,
 		ctxCancel:   cancel,
-		messages:    make(chan Message),
+		events:      newEventBus(),
+		recent:      newRecentMessages(),
+		seen:        newSeenMessages(),
 
 		topics:              map[string]*pubsub.Topic{},
 		subs:                map[string]*pubsub.Subscription{},
 		knownChannelMembers: map[string]int{},
+		peerEventsStop:      map[string]func(){},
+		profileFetched:      map[peer.ID]time.Time{},
+		nickOwners:          map[string]map[peer.ID]struct{}{},
+		deliveries:          map[string]*Delivery{},
+		fileOffers:          map[string][]*fileOffer{},
+		blobsBusy:           map[string]chan struct{}{},
+		downloads:           map[string]struct{}{},
+		typingSent:          map[string]typingSent{},
+		channelMeta:         map[string]knownMeta{},
+
+		presence: presenceTracker{
+			peers: map[peer.ID]Presence{},
+		},
 	}
 
 	h := errhelper.New("libp2p new")
@@ -106,6 +201,29 @@ func NewNode(cfg Config) (*Node, error) {
 		cfg.RejoinInterval = 30 * time.Second
 	}
 
+	if err := CheckNickname(cfg.Nickname); err != nil {
+		return nil, h.Fail(err)
+	}
+
+	if cfg.HistoryDir != "" {
+		n.history, err = openHistory(cfg.HistoryDir)
+		if err != nil {
+			return nil, h.Fail(err)
+		}
+	}
+
+	if cfg.ContactsPath != "" {
+		n.contacts, err = loadContacts(cfg.ContactsPath)
+		if err != nil {
+			return nil, h.Fail(err)
+		}
+	}
+
+	n.outbox, err = newOutbox(cfg.OutboxPath)
+	if err != nil {
+		return nil, h.Fail(err)
+	}
+
 	opts := []libp2p.Option{
 		libp2p.Identity(privKey),
 		libp2p.Security(noise.ID, noise.New),
@@ -172,6 +290,14 @@ func NewNode(cfg Config) (*Node, error) {
 
 	n.Discover = discovery.NewRoutingDiscovery(n.kdht)
 
+	if cfg.PeersPath != "" {
+		n.savedPeers, err = n.loadPeers()
+		if err != nil {
+			n.Cfg.Log.Printf("Failed to load known peers: %v", err)
+		}
+		go n.peersGoroutine()
+	}
+
 	if cfg.MDNSInterval != 0 {
 		n.MDNSService, err = libp2pdiscovery.NewMdnsService(n.nodeContext, n.Host, cfg.MDNSInterval, libp2pdiscovery.ServiceTag)
 		if err != nil {
@@ -182,6 +308,14 @@ func NewNode(cfg Config) (*Node, error) {
 		n.MDNSService.RegisterNotifee(n)
 	}
 
+	reachabilitySub, err := n.Host.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		return nil, h.Fail(err)
+	}
+	h.CleanupClose(reachabilitySub)
+	go n.watchReachability(reachabilitySub)
+	n.watchConnections()
+
 	n.AutonatProto, err = autonat.New(ctx, n.Host)
 	if err != nil {
 		return nil, h.Fail(err)
@@ -198,11 +332,33 @@ func NewNode(cfg Config) (*Node, error) {
 
 	n.PingProto = ping.NewPingService(n.Host)
 
+	if err := n.startPresence(); err != nil {
+		return nil, h.Fail(err)
+	}
+	go n.outboxGoroutine()
+
+	n.Host.SetStreamHandler(DMProtocol, n.handleDMStream)
+	n.Host.SetStreamHandler(HistorySyncProtocol, n.handleHistoryStream)
+	n.Host.SetStreamHandler(FileProtocol, n.handleFileStream)
+	n.Host.SetStreamHandler(BlobProtocol, n.handleBlobStream)
+	n.Host.SetStreamHandler(ChannelMetaProtocol, n.handleChannelMetaStream)
+
+	n.profile, err = n.signProfile(cfg.Nickname)
+	if err != nil {
+		return nil, h.Fail(err)
+	}
+	n.Host.SetStreamHandler(ProfileProtocol, n.handleProfileStream)
+
 	return n, nil
 }
 
 func (n *Node) Run() {
 	counter := 0
+	if len(n.savedPeers) != 0 {
+		counter += n.dialSavedPeers()
+		n.Cfg.Log.Printf("Reconnected to %d previously known peers", counter)
+	}
+
 	for _, bs := range n.Cfg.Bootstrap {
 		ma, err := multiaddr.NewMultiaddr(bs)
 		if err != nil {
@@ -225,7 +381,7 @@ func (n *Node) Run() {
 		}
 	}
 
-	if len(n.Cfg.Bootstrap) != 0 {
+	if len(n.Cfg.Bootstrap) != 0 || counter != 0 {
 		n.Cfg.Log.Printf("Entangling fabric of infinity... %d bootstrap peers", counter)
 		n.kdht.Bootstrap(n.nodeContext)
 	} else {
@@ -234,7 +390,11 @@ func (n *Node) Run() {
 }
 
 func (n *Node) Close() error {
-	defer close(n.messages)
+	defer n.events.close()
+
+	if err := n.savePeers(); err != nil {
+		n.Cfg.Log.Printf("Failed to save known peers: %v", err)
+	}
 
 	n.ctxCancel()
 
@@ -244,6 +404,12 @@ func (n *Node) Close() error {
 	return n.Host.Close()
 }
 
+// Context returns the context that is cancelled when the node is closed. It
+// should be used for long operations started by UIs, such as downloads.
+func (n *Node) Context() context.Context {
+	return n.nodeContext
+}
+
 func (n *Node) ID() peer.ID {
 	return n.Host.ID()
 }
@@ -285,13 +451,63 @@ func (n *Node) IsConnected(pid peer.ID) bool {
 }
 
 type Message struct {
+	// Unique message identifier, assigned by the sender.
+	ID string
+
 	Sender  peer.ID
 	Channel string
-	Text    string
-}
 
-func (n *Node) Messages() <-chan Message {
-	return n.messages
+	// Timestamp claimed by the sender. Can not be trusted and should be used
+	// only for display purposes.
+	Timestamp time.Time
+
+	Kind MessageKind
+	Text string
+
+	// ID of the message this one is a reply to, if any.
+	ReplyTo string
+
+	// ID of the message changed by KindEdit and KindDelete messages.
+	Target string
+
+	// File offered by KindFile messages.
+	File *FileInfo
+
+	// Attachments of the message, they are fetched on demand using
+	// Node.FetchAttachment.
+	Attachments []FileInfo
+
+	// Edited is set by Node.History for messages that were changed by
+	// a KindEdit message, Text is the updated text then.
+	Edited bool
+
+	// Reactions is set by Node.History to the amount of peers that reacted
+	// to the message, by reaction.
+	Reactions map[string]int
+
+	Extensions map[string]string
+
+	// Signed channel metadata record carried by KindTopic messages.
+	meta *channelMetaRecord
+
+	// RelayedBy is set for messages obtained from other channel members via
+	// history sync. The signed pubsub message is relayed as is, so the Sender
+	// is verified the same way as for messages received directly.
+	RelayedBy peer.ID
+
+	// Unverified is set for relayed messages saved by older versions that
+	// did not check the signature of the Sender. Sender of such messages can
+	// only be trusted as much as RelayedBy is trusted.
+	Unverified bool
+
+	// Pubsub message as received from the network, including the signature
+	// of the sender. Sent to other members via history sync.
+	signed []byte
+
+	// Legacy is set for messages received from nodes that send raw text
+	// instead of the structured envelope. Such messages have ID and
+	// Timestamp fields assigned locally.
+	Legacy bool
 }
 
 func (n *Node) HandlePeerFound(pi peer.AddrInfo) {
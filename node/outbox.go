@@ -0,0 +1,306 @@
+package infchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outbox keeps channel messages we posted until they are published to at
+// least one peer. Pending messages are saved to Cfg.OutboxPath (if set) and
+// retried after restart once the channel is joined again.
+
+type DeliveryState string
+
+const (
+	DeliveryPending DeliveryState = "pending"
+	DeliverySent    DeliveryState = "sent"
+	DeliveryFailed  DeliveryState = "failed"
+)
+
+const (
+	outboxMinBackoff = 5 * time.Second
+	outboxMaxBackoff = 5 * time.Minute
+
+	// Message is considered failed after that many publish errors.
+	outboxMaxAttempts = 8
+
+	// Message is considered failed if it was not sent within that time,
+	// e.g. because there were no channel peers all this time.
+	OutboxExpiry = 24 * time.Hour
+
+	// How often to check queued messages even if nothing happens. Pubsub
+	// peer events are not fully reliable.
+	outboxPollInterval = 30 * time.Second
+
+	outboxPublishTimeout = 30 * time.Second
+)
+
+var ErrOutboxExpired = errors.New("message was not delivered in time")
+
+// DeliveryEvent is generated when the state of the message we posted
+// changes.
+type DeliveryEvent struct {
+	Channel   string
+	MessageID string
+	State     DeliveryState
+
+	// Amount of channel peers the message was published to. Set only for
+	// DeliverySent.
+	Peers int
+
+	// Reason of the failure. Set only for DeliveryFailed.
+	Err error
+}
+
+func (DeliveryEvent) Type() EventType { return EventDelivery }
+
+type outboxEntry struct {
+	Channel   string    `json:"channel"`
+	MessageID string    `json:"id"`
+	Queued    time.Time `json:"queued"`
+	// Encoded message envelope, not encrypted.
+	Payload []byte `json:"payload"`
+
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+type outbox struct {
+	path string
+
+	lock    sync.Mutex
+	entries []*outboxEntry
+
+	kick chan struct{}
+}
+
+func newOutbox(path string) (*outbox, error) {
+	ob := &outbox{
+		path: path,
+		kick: make(chan struct{}, 1),
+	}
+	if path == "" {
+		return ob, nil
+	}
+
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ob, nil
+		}
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	if err := json.Unmarshal(blob, &ob.entries); err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	return ob, nil
+}
+
+// save writes pending entries to disk. Lock should be held by the caller.
+func (ob *outbox) save() error {
+	if ob.path == "" {
+		return nil
+	}
+	blob, err := json.Marshal(ob.entries)
+	if err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	// Contains private channel descriptors with keys.
+	if err := ioutil.WriteFile(ob.path+".tmp", blob, 0600); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	if err := os.Rename(ob.path+".tmp", ob.path); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return nil
+}
+
+// wakeup makes outboxGoroutine check pending messages.
+func (ob *outbox) wakeup() {
+	select {
+	case ob.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (ob *outbox) remove(e *outboxEntry) {
+	for i, other := range ob.entries {
+		if other == e {
+			ob.entries = append(ob.entries[:i], ob.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// enqueue adds the message to the outbox and wakes up the sender.
+func (n *Node) enqueue(msg Message, payload []byte) {
+	n.outbox.lock.Lock()
+	n.outbox.entries = append(n.outbox.entries, &outboxEntry{
+		Channel:   msg.Channel,
+		MessageID: msg.ID,
+		Queued:    time.Now(),
+		Payload:   payload,
+	})
+	err := n.outbox.save()
+	n.outbox.lock.Unlock()
+	if err != nil {
+		// Still can be sent, it just won't survive the restart.
+		n.Cfg.Log.Printf("Failed to save outbox: %v", err)
+	}
+
+	n.reportDelivery(DeliveryEvent{
+		Channel:   msg.Channel,
+		MessageID: msg.ID,
+		State:     DeliveryPending,
+	})
+	n.outbox.wakeup()
+}
+
+// PendingMessages returns IDs of messages posted to the channel that are not
+// sent yet.
+func (n *Node) PendingMessages(descr string) []string {
+	n.outbox.lock.Lock()
+	defer n.outbox.lock.Unlock()
+
+	var ids []string
+	for _, e := range n.outbox.entries {
+		if e.Channel == descr {
+			ids = append(ids, e.MessageID)
+		}
+	}
+	return ids
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// publishEntry tries to send the queued message. It returns false if the
+// message can not be sent right now because we are not joined or there are
+// no channel peers.
+func (n *Node) publishEntry(e *outboxEntry) (sent bool, peers int, err error) {
+	n.pubsubLock.Lock()
+	topic, ok := n.topics[e.Channel]
+	n.pubsubLock.Unlock()
+	if !ok {
+		return false, 0, nil
+	}
+	peers = len(topic.ListPeers())
+	if peers == 0 {
+		return false, 0, nil
+	}
+
+	payload := e.Payload
+	if IsPrivateChannel(e.Channel) {
+		payload, err = sealPayload(e.Channel, payload)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(n.nodeContext, outboxPublishTimeout)
+	defer cancel()
+	if err := topic.Publish(ctx, payload); err != nil {
+		return false, 0, err
+	}
+	return true, peers, nil
+}
+
+// processOutbox sends all messages that can be sent now, preserving the
+// order of messages in each channel.
+func (n *Node) processOutbox() {
+	n.outbox.lock.Lock()
+	entries := make([]*outboxEntry, len(n.outbox.entries))
+	copy(entries, n.outbox.entries)
+	n.outbox.lock.Unlock()
+
+	blocked := map[string]bool{}
+	for _, e := range entries {
+		if blocked[e.Channel] {
+			continue
+		}
+
+		var (
+			ev    DeliveryEvent
+			sent  bool
+			peers int
+			err   error
+		)
+		if time.Since(e.Queued) > OutboxExpiry {
+			err = ErrOutboxExpired
+		} else if time.Now().Before(e.NextAttempt) {
+			blocked[e.Channel] = true
+			continue
+		} else {
+			sent, peers, err = n.publishEntry(e)
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+		}
+
+		n.outbox.lock.Lock()
+		changed := true
+		switch {
+		case sent:
+			n.outbox.remove(e)
+			ev = DeliveryEvent{State: DeliverySent, Peers: peers}
+		case err == ErrOutboxExpired:
+			n.outbox.remove(e)
+			ev = DeliveryEvent{State: DeliveryFailed, Err: err}
+		case err != nil:
+			e.Attempts++
+			if e.Attempts >= outboxMaxAttempts {
+				n.outbox.remove(e)
+				ev = DeliveryEvent{State: DeliveryFailed, Err: err}
+			} else {
+				e.NextAttempt = time.Now().Add(outboxBackoff(e.Attempts))
+				n.Cfg.Log.Printf("Publish failed, will retry in %v: %v", outboxBackoff(e.Attempts), err)
+			}
+			blocked[e.Channel] = true
+		default:
+			// Not joined or no peers, wait.
+			blocked[e.Channel] = true
+			changed = false
+		}
+		if changed {
+			if err := n.outbox.save(); err != nil {
+				n.Cfg.Log.Printf("Failed to save outbox: %v", err)
+			}
+		}
+		n.outbox.lock.Unlock()
+
+		if ev.State != "" {
+			ev.Channel = e.Channel
+			ev.MessageID = e.MessageID
+			n.reportDelivery(ev)
+		}
+	}
+}
+
+func (n *Node) outboxGoroutine() {
+	t := time.NewTicker(outboxPollInterval)
+	defer t.Stop()
+	for {
+		n.processOutbox()
+
+		select {
+		case <-n.outbox.kick:
+		case <-t.C:
+		case <-n.nodeContext.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package infchat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: outboxMinBackoff},
+		{attempts: 1, want: outboxMinBackoff},
+		{attempts: 2, want: 2 * outboxMinBackoff},
+		{attempts: 3, want: 4 * outboxMinBackoff},
+		{attempts: 6, want: 32 * outboxMinBackoff},
+		{attempts: 7, want: outboxMaxBackoff},
+		{attempts: outboxMaxAttempts, want: outboxMaxBackoff},
+		{attempts: 1000, want: outboxMaxBackoff},
+	}
+	for _, c := range cases {
+		if got := outboxBackoff(c.attempts); got != c.want {
+			t.Errorf("outboxBackoff(%d): want %v, got %v", c.attempts, c.want, got)
+		}
+	}
+
+	prev := time.Duration(0)
+	for attempts := 1; attempts <= outboxMaxAttempts; attempts++ {
+		got := outboxBackoff(attempts)
+		if got < prev {
+			t.Errorf("backoff decreased after %d attempts: %v < %v", attempts, got, prev)
+		}
+		if got > outboxMaxBackoff {
+			t.Errorf("backoff after %d attempts exceeds the maximum: %v", attempts, got)
+		}
+		prev = got
+	}
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infchat-outbox-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	ob, err := newOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ob.entries) != 0 {
+		t.Fatalf("new outbox is not empty: %d entries", len(ob.entries))
+	}
+	ob.entries = []*outboxEntry{
+		{Channel: "#a", MessageID: "1", Queued: time.Unix(1588000000, 0), Payload: []byte(`{"v":1}`)},
+		{Channel: "#a", MessageID: "2", Queued: time.Unix(1588000001, 0), Attempts: 3,
+			NextAttempt: time.Unix(1588000100, 0)},
+	}
+	if err := ob.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("outbox file is accessible by others: %v", info.Mode())
+	}
+
+	loaded, err := newOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.entries) != 2 {
+		t.Fatalf("wrong amount of entries: %d", len(loaded.entries))
+	}
+	for i, e := range loaded.entries {
+		want := ob.entries[i]
+		if e.Channel != want.Channel || e.MessageID != want.MessageID || string(e.Payload) != string(want.Payload) ||
+			e.Attempts != want.Attempts || !e.Queued.Equal(want.Queued) || !e.NextAttempt.Equal(want.NextAttempt) {
+			t.Errorf("entry %d changed: want %+v, got %+v", i, want, e)
+		}
+	}
+}
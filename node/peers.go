@@ -0,0 +1,200 @@
+package infchat
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Known peers are saved to the file on Close and periodically so we can
+// reconnect to the network via them on the next start even if bootstrap
+// nodes are not reachable.
+
+const (
+	peersSaveInterval = 10 * time.Minute
+
+	// Maximum amount of peers saved.
+	maxSavedPeers = 500
+
+	// Amount of saved peers we try to connect to in Run.
+	savedPeersDial = 20
+)
+
+type savedPeer struct {
+	ID    string   `json:"id"`
+	Addrs []string `json:"addrs"`
+	// Latency EWMA in nanoseconds, zero if unknown.
+	Latency time.Duration `json:"latency,omitempty"`
+	// Whether peer was in the DHT routing table.
+	DHT bool `json:"dht,omitempty"`
+}
+
+type peersSnapshot struct {
+	Saved time.Time   `json:"saved"`
+	Peers []savedPeer `json:"peers"`
+}
+
+// snapshotPeers collects routing table peers and currently connected peers,
+// routing table ones go first.
+func (n *Node) snapshotPeers() peersSnapshot {
+	snap := peersSnapshot{Saved: time.Now()}
+	seen := map[peer.ID]bool{}
+	ps := n.Host.Peerstore()
+
+	add := func(pid peer.ID, dht bool) {
+		if seen[pid] || pid == n.ID() || len(snap.Peers) >= maxSavedPeers {
+			return
+		}
+		addrs := ps.Addrs(pid)
+		if len(addrs) == 0 {
+			return
+		}
+		seen[pid] = true
+
+		sp := savedPeer{
+			ID:      peer.Encode(pid),
+			Latency: ps.LatencyEWMA(pid),
+			DHT:     dht,
+		}
+		for _, a := range addrs {
+			sp.Addrs = append(sp.Addrs, a.String())
+		}
+		snap.Peers = append(snap.Peers, sp)
+	}
+
+	for _, pid := range n.kdht.RoutingTable().ListPeers() {
+		add(pid, true)
+	}
+	for _, pid := range n.Host.Network().Peers() {
+		add(pid, false)
+	}
+	return snap
+}
+
+func (n *Node) savePeers() error {
+	if n.Cfg.PeersPath == "" {
+		return nil
+	}
+
+	blob, err := json.Marshal(n.snapshotPeers())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(n.Cfg.PeersPath+".tmp", blob, 0600); err != nil {
+		return err
+	}
+	return os.Rename(n.Cfg.PeersPath+".tmp", n.Cfg.PeersPath)
+}
+
+// loadPeers adds peers from the saved snapshot to the peerstore and returns
+// their IDs, best candidates for reconnection first.
+func (n *Node) loadPeers() ([]peer.ID, error) {
+	blob, err := ioutil.ReadFile(n.Cfg.PeersPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snap peersSnapshot
+	if err := json.Unmarshal(blob, &snap); err != nil {
+		return nil, err
+	}
+
+	// Prefer DHT peers, then ones with lower latency.
+	sort.SliceStable(snap.Peers, func(i, j int) bool {
+		a, b := snap.Peers[i], snap.Peers[j]
+		if a.DHT != b.DHT {
+			return a.DHT
+		}
+		if a.Latency == 0 || b.Latency == 0 {
+			return a.Latency != 0
+		}
+		return a.Latency < b.Latency
+	})
+
+	ps := n.Host.Peerstore()
+	res := make([]peer.ID, 0, len(snap.Peers))
+	for _, sp := range snap.Peers {
+		pid, err := peer.Decode(sp.ID)
+		if err != nil || pid == n.ID() {
+			continue
+		}
+		addrs := make([]multiaddr.Multiaddr, 0, len(sp.Addrs))
+		for _, a := range sp.Addrs {
+			ma, err := multiaddr.NewMultiaddr(a)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, ma)
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+
+		ps.AddAddrs(pid, addrs, peerstore.AddressTTL)
+		if sp.Latency != 0 {
+			ps.RecordLatency(pid, sp.Latency)
+		}
+		res = append(res, pid)
+	}
+	return res, nil
+}
+
+// dialSavedPeers connects to the peers loaded from the snapshot in parallel
+// and returns the amount of successful connections. Connected DHT servers
+// are added to the routing table automatically.
+func (n *Node) dialSavedPeers() int {
+	peers := n.savedPeers
+	if len(peers) > savedPeersDial {
+		peers = peers[:savedPeersDial]
+	}
+
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		connected int
+	)
+	for _, pid := range peers {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(n.nodeContext, 15*time.Second)
+			defer cancel()
+			if err := n.Host.Connect(ctx, peer.AddrInfo{ID: pid}); err != nil {
+				return
+			}
+
+			lock.Lock()
+			connected++
+			lock.Unlock()
+		}(pid)
+	}
+	wg.Wait()
+
+	return connected
+}
+
+func (n *Node) peersGoroutine() {
+	t := time.NewTicker(peersSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := n.savePeers(); err != nil {
+				n.Cfg.Log.Printf("Failed to save known peers: %v", err)
+			}
+		case <-n.nodeContext.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package infchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// PresenceTopic is the pubsub topic each node periodically publishes its
+// presence record on. Records are authenticated by pubsub message
+// signatures.
+const PresenceTopic = "/infinitychat/v0.1/presence"
+
+const (
+	DefaultPresenceInterval = 2 * time.Minute
+
+	// Presence of the peer is forgotten if no record was received for
+	// presenceExpiry intervals.
+	presenceExpiry = 3
+
+	MaxStatusTextLen = 256
+)
+
+type PresenceState string
+
+const (
+	PresenceOnline PresenceState = "online"
+	PresenceAway   PresenceState = "away"
+	PresenceBusy   PresenceState = "busy"
+)
+
+type Presence struct {
+	State PresenceState
+	// Optional free-form status, e.g. away reason.
+	Text string
+
+	// When the record was received (or set for our own presence).
+	Updated time.Time
+}
+
+// PresenceEvent is generated when the peer changes its presence state or
+// status text.
+type PresenceEvent struct {
+	Peer     peer.ID
+	Presence Presence
+}
+
+func (PresenceEvent) Type() EventType { return EventPresence }
+
+type presenceRecord struct {
+	State PresenceState `json:"state"`
+	Text  string        `json:"text,omitempty"`
+}
+
+type presenceTracker struct {
+	lock  sync.Mutex
+	own   Presence
+	peers map[peer.ID]Presence
+	topic *pubsub.Topic
+}
+
+func checkPresence(state PresenceState, text string) error {
+	switch state {
+	case PresenceOnline, PresenceAway, PresenceBusy:
+	default:
+		return fmt.Errorf("presence: unknown state: %s", state)
+	}
+	if len(text) > MaxStatusTextLen {
+		return errors.New("presence: status text is too long")
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return errors.New("presence: status text can not contain line breaks")
+	}
+	return nil
+}
+
+func (n *Node) presenceInterval() time.Duration {
+	if n.Cfg.PresenceInterval == 0 {
+		return DefaultPresenceInterval
+	}
+	return n.Cfg.PresenceInterval
+}
+
+// startPresence joins the presence topic and starts goroutines that publish
+// our presence and track presence of other peers.
+func (n *Node) startPresence() error {
+	n.presence.own = Presence{State: PresenceOnline, Updated: time.Now()}
+
+	topic, err := n.PubsubProto.Join(PresenceTopic)
+	if err != nil {
+		return fmt.Errorf("presence: %w", err)
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()
+		return fmt.Errorf("presence: %w", err)
+	}
+	n.presence.topic = topic
+
+	go n.pullPresence(sub)
+	go n.presenceGoroutine()
+	return nil
+}
+
+func (n *Node) publishPresence() error {
+	n.presence.lock.Lock()
+	rec := presenceRecord{
+		State: n.presence.own.State,
+		Text:  n.presence.own.Text,
+	}
+	n.presence.lock.Unlock()
+
+	blob, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("presence: %w", err)
+	}
+	return n.presence.topic.Publish(n.nodeContext, blob)
+}
+
+func (n *Node) presenceGoroutine() {
+	// Give the node some time to find peers first.
+	select {
+	case <-time.After(10 * time.Second):
+	case <-n.nodeContext.Done():
+		return
+	}
+
+	t := time.NewTicker(n.presenceInterval())
+	defer t.Stop()
+	for {
+		if err := n.publishPresence(); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			n.Cfg.Log.Printf("Presence publish failed: %v", err)
+		}
+
+		select {
+		case <-t.C:
+		case <-n.nodeContext.Done():
+			return
+		}
+	}
+}
+
+func (n *Node) pullPresence(sub *pubsub.Subscription) {
+	defer sub.Cancel()
+	for {
+		msg, err := sub.Next(n.nodeContext)
+		if err != nil {
+			return
+		}
+
+		sender := msg.GetFrom()
+		if sender == n.ID() {
+			continue
+		}
+
+		var rec presenceRecord
+		if err := json.Unmarshal(msg.Data, &rec); err != nil {
+			continue
+		}
+		if err := checkPresence(rec.State, rec.Text); err != nil {
+			continue
+		}
+
+		p := Presence{State: rec.State, Text: rec.Text, Updated: time.Now()}
+
+		n.presence.lock.Lock()
+		old, ok := n.presence.peers[sender]
+		n.presence.peers[sender] = p
+		n.presence.lock.Unlock()
+
+		if !ok || old.State != p.State || old.Text != p.Text {
+			n.events.publish(PresenceEvent{Peer: sender, Presence: p})
+		}
+	}
+}
+
+// SetPresence changes our presence state and announces it to the network.
+func (n *Node) SetPresence(state PresenceState, text string) error {
+	if err := checkPresence(state, text); err != nil {
+		return err
+	}
+
+	n.presence.lock.Lock()
+	n.presence.own = Presence{State: state, Text: text, Updated: time.Now()}
+	n.presence.lock.Unlock()
+
+	go func() {
+		if err := n.publishPresence(); err != nil {
+			n.Cfg.Log.Printf("Presence publish failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Presence returns the last known presence of the peer. False is returned if
+// the peer did not announce its presence recently.
+func (n *Node) Presence(pid peer.ID) (Presence, bool) {
+	n.presence.lock.Lock()
+	defer n.presence.lock.Unlock()
+
+	if pid == n.ID() {
+		return n.presence.own, true
+	}
+
+	p, ok := n.presence.peers[pid]
+	if !ok {
+		return Presence{}, false
+	}
+	if time.Since(p.Updated) > presenceExpiry*n.presenceInterval() {
+		delete(n.presence.peers, pid)
+		return Presence{}, false
+	}
+	return p, true
+}
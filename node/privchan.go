@@ -0,0 +1,133 @@
+package infchat
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Private channels are channels with descriptors in form #name:key, where key
+// is a base64url-encoded 256-bit secret shared by all members.
+//
+// Pubsub topic name for the private channel is derived from the key so
+// nobody who does not know the key can find the channel members via DHT or
+// subscribe to the topic. All messages are additionally encrypted using
+// XChaCha20-Poly1305 with another key derived from the secret.
+
+const (
+	ChannelKeySize = 32
+
+	privTopicPrefix = ChanPrefix + "private/"
+)
+
+var ErrNotPrivate = errors.New("not a private channel")
+
+// NewChannelKey generates a new random secret for the private channel.
+func NewChannelKey() string {
+	key := make([]byte, ChannelKeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// IsPrivateChannel reports whether the descriptor refers to the encrypted
+// channel.
+func IsPrivateChannel(descr string) bool {
+	return strings.HasPrefix(descr, ChanPrefix) &&
+		strings.Contains(strings.TrimPrefix(descr, ChanPrefix), ":")
+}
+
+// parsePrivateChannel splits the private channel descriptor into the channel
+// name and secret.
+func parsePrivateChannel(descr string) (string, []byte, error) {
+	if !IsPrivateChannel(descr) {
+		return "", nil, ErrNotPrivate
+	}
+	parts := strings.SplitN(strings.TrimPrefix(descr, ChanPrefix), ":", 2)
+	key, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid channel key: %w", err)
+	}
+	if len(key) != ChannelKeySize {
+		return "", nil, errors.New("invalid channel key: wrong length")
+	}
+	return parts[0], key, nil
+}
+
+func deriveChannelKey(descr, purpose string, length int) ([]byte, error) {
+	name, secret, err := parsePrivateChannel(descr)
+	if err != nil {
+		return nil, err
+	}
+
+	derived := make([]byte, length)
+	kdf := hkdf.New(sha256.New, secret, []byte(name), []byte("infinitychat "+purpose))
+	if _, err := io.ReadFull(kdf, derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
+
+// TopicName returns the name of the pubsub topic (and DHT rendezvous point)
+// used for the channel.
+//
+// It is the descriptor itself for public channels.
+func TopicName(descr string) string {
+	if !IsPrivateChannel(descr) {
+		return descr
+	}
+	id, err := deriveChannelKey(descr, "topic", 32)
+	if err != nil {
+		// Such descriptor will not pass validation on join anyway.
+		return descr
+	}
+	return privTopicPrefix + hex.EncodeToString(id)
+}
+
+func channelCipher(descr string) (cipher.AEAD, error) {
+	key, err := deriveChannelKey(descr, "message key", chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
+
+// sealPayload encrypts the message payload for the private channel.
+//
+// Result is the random nonce followed by the ciphertext. Topic name is used
+// as associated data.
+func sealPayload(descr string, payload []byte) ([]byte, error) {
+	aead, err := channelCipher(descr)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, payload, []byte(TopicName(descr))), nil
+}
+
+func openPayload(descr string, sealed []byte) ([]byte, error) {
+	aead, err := channelCipher(descr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted payload is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(TopicName(descr)))
+}
@@ -0,0 +1,129 @@
+package infchat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	descr := ChanPrefix + "test:" + NewChannelKey()
+	otherKey := ChanPrefix + "test:" + NewChannelKey()
+	otherName := ChanPrefix + "other:" + strings.SplitN(descr, ":", 2)[1]
+	payload := []byte(`{"v":1,"id":"abc","text":"secret"}`)
+
+	sealed, err := sealPayload(descr, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("payload is not encrypted")
+	}
+
+	cases := []struct {
+		name   string
+		descr  string
+		sealed func() []byte
+		fail   bool
+	}{
+		{
+			name:   "round-trip",
+			descr:  descr,
+			sealed: func() []byte { return sealed },
+		},
+		{
+			name:  "flipped ciphertext bit",
+			descr: descr,
+			sealed: func() []byte {
+				b := append([]byte(nil), sealed...)
+				b[len(b)-1] ^= 1
+				return b
+			},
+			fail: true,
+		},
+		{
+			name:  "flipped nonce bit",
+			descr: descr,
+			sealed: func() []byte {
+				b := append([]byte(nil), sealed...)
+				b[0] ^= 1
+				return b
+			},
+			fail: true,
+		},
+		{
+			name:   "truncated",
+			descr:  descr,
+			sealed: func() []byte { return sealed[:len(sealed)-1] },
+			fail:   true,
+		},
+		{
+			name:   "shorter than nonce",
+			descr:  descr,
+			sealed: func() []byte { return sealed[:4] },
+			fail:   true,
+		},
+		{
+			name:   "wrong key",
+			descr:  otherKey,
+			sealed: func() []byte { return sealed },
+			fail:   true,
+		},
+		{
+			name:   "same key, other channel",
+			descr:  otherName,
+			sealed: func() []byte { return sealed },
+			fail:   true,
+		},
+		{
+			name:   "public channel",
+			descr:  ChanPrefix + "test",
+			sealed: func() []byte { return sealed },
+			fail:   true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opened, err := openPayload(c.descr, c.sealed())
+			if c.fail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if !bytes.Equal(opened, payload) {
+				t.Errorf("wrong payload: want %q, got %q", payload, opened)
+			}
+		})
+	}
+}
+
+func TestRedactDescriptor(t *testing.T) {
+	key := NewChannelKey()
+
+	cases := []struct {
+		descr string
+		want  string
+	}{
+		{descr: ChanPrefix + "test", want: "#test"},
+		{descr: "#test", want: "#test"},
+		{descr: ChanPrefix + "test:" + key, want: "#test:***"},
+		{descr: "#test:" + key, want: "#test:***"},
+		{descr: "@QmPeer", want: "@QmPeer"},
+		{descr: "", want: ""},
+	}
+	for _, c := range cases {
+		got := RedactDescriptor(c.descr)
+		if got != c.want {
+			t.Errorf("RedactDescriptor(%q): want %q, got %q", c.descr, c.want, got)
+		}
+		if strings.Contains(got, key) {
+			t.Errorf("RedactDescriptor(%q) contains the key", c.descr)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package infchat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// ProfileProtocol is used to exchange signed profile records between peers.
+//
+// Both sides send their own JSON-encoded profileRecord, the initiator sends
+// it first.
+const ProfileProtocol protocol.ID = "/infinitychat/v0.1/profile"
+
+const (
+	// Peerstore key used to cache the received profileRecord.
+	profileKey = "infinitychat/profile"
+
+	// Profile is refreshed when we see the peer after this interval.
+	profileRefreshInterval = AdvertiseTTL
+
+	MaxNicknameLen = 32
+
+	// Separates the nickname from the peer ID suffix when several peers use
+	// the same nickname. It is not allowed in nicknames, so the result can
+	// not be claimed by anybody else.
+	nickSuffixSep = "~"
+	nickSuffixLen = 6
+)
+
+// profileRecord is the information each node publishes about itself.
+type profileRecord struct {
+	Peer     string `json:"peer"`
+	Nickname string `json:"nick"`
+	// Records with the higher sequence number replace records with the
+	// lower one. Currently it is the creation timestamp in nanoseconds.
+	Seq uint64 `json:"seq"`
+
+	Signature []byte `json:"sig"`
+}
+
+func (r profileRecord) signedData() []byte {
+	return []byte("infinitychat-profile\n" + r.Peer + "\n" +
+		strconv.FormatUint(r.Seq, 10) + "\n" + r.Nickname)
+}
+
+func (r profileRecord) verify(pid peer.ID) error {
+	if r.Peer != peer.Encode(pid) {
+		return errors.New("profile: record is for another peer")
+	}
+	pubKey, err := pid.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("profile: %w", err)
+	}
+	ok, err := pubKey.Verify(r.signedData(), r.Signature)
+	if err != nil {
+		return fmt.Errorf("profile: %w", err)
+	}
+	if !ok {
+		return errors.New("profile: signature verification failed")
+	}
+	return CheckNickname(r.Nickname)
+}
+
+// reservedNames are used by UIs for their own messages and can not be used
+// as nicknames or petnames.
+var reservedNames = []string{"local"}
+
+func isReservedName(name string) bool {
+	for _, reserved := range reservedNames {
+		if strings.EqualFold(name, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckNickname checks whether the string can be used as a nickname.
+//
+// Empty string is allowed and means "no nickname".
+func CheckNickname(nick string) error {
+	if len(nick) > MaxNicknameLen {
+		return errors.New("nickname is too long")
+	}
+	if isReservedName(nick) {
+		return fmt.Errorf("nickname %s is reserved", nick)
+	}
+	if _, err := peer.Decode(nick); err == nil {
+		// Otherwise it can be confused with the peer ID shown for peers
+		// without a nickname.
+		return errors.New("nickname can not be a peer ID")
+	}
+	for i, r := range nick {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			continue
+		}
+		switch r {
+		case '-', '_', '[', ']', '{', '}', '\\', '^', '`', '|', '.':
+			if i == 0 && r == '.' {
+				return errors.New("nickname can not start with a dot")
+			}
+			continue
+		}
+		return fmt.Errorf("nickname can not contain %q", r)
+	}
+	return nil
+}
+
+func (n *Node) signProfile(nick string) (profileRecord, error) {
+	rec := profileRecord{
+		Peer:     peer.Encode(n.ID()),
+		Nickname: nick,
+		Seq:      uint64(time.Now().UnixNano()),
+	}
+
+	privKey := n.Host.Peerstore().PrivKey(n.ID())
+	if privKey == nil {
+		return profileRecord{}, errors.New("profile: no private key")
+	}
+
+	var err error
+	rec.Signature, err = privKey.Sign(rec.signedData())
+	if err != nil {
+		return profileRecord{}, fmt.Errorf("profile: %w", err)
+	}
+	return rec, nil
+}
+
+// SetNickname changes our nickname and announces it to the known peers.
+func (n *Node) SetNickname(nick string) error {
+	if err := CheckNickname(nick); err != nil {
+		return err
+	}
+
+	rec, err := n.signProfile(nick)
+	if err != nil {
+		return err
+	}
+
+	n.profileLock.Lock()
+	n.profile = rec
+	n.profileLock.Unlock()
+
+	go func() {
+		for _, p := range n.Host.Network().Peers() {
+			protos, err := n.Host.Peerstore().SupportsProtocols(p, string(ProfileProtocol))
+			if err != nil || len(protos) == 0 {
+				continue
+			}
+			if err := n.exchangeProfile(p); err != nil {
+				n.Cfg.Log.Printf("Failed to send profile to %v: %v", p, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (n *Node) ownProfile() profileRecord {
+	n.profileLock.Lock()
+	defer n.profileLock.Unlock()
+	return n.profile
+}
+
+// saveProfile verifies the profile record received from the peer and saves it
+// if it is newer than the one we have.
+func (n *Node) saveProfile(pid peer.ID, rec profileRecord) error {
+	if err := rec.verify(pid); err != nil {
+		return err
+	}
+
+	n.profileLock.Lock()
+	defer n.profileLock.Unlock()
+
+	n.profileFetched[pid] = time.Now()
+
+	old, ok := n.cachedProfile(pid)
+	if ok && old.Seq >= rec.Seq {
+		return nil
+	}
+	if err := n.Host.Peerstore().Put(pid, profileKey, rec); err != nil {
+		return err
+	}
+
+	if ok && old.Nickname != "" {
+		delete(n.nickOwners[old.Nickname], pid)
+		if len(n.nickOwners[old.Nickname]) == 0 {
+			delete(n.nickOwners, old.Nickname)
+		}
+	}
+	if rec.Nickname != "" {
+		if n.nickOwners[rec.Nickname] == nil {
+			n.nickOwners[rec.Nickname] = map[peer.ID]struct{}{}
+		}
+		n.nickOwners[rec.Nickname][pid] = struct{}{}
+	}
+	return nil
+}
+
+// nickShared reports whether somebody else than pid uses the same nickname.
+func (n *Node) nickShared(nick string, pid peer.ID) bool {
+	n.profileLock.Lock()
+	defer n.profileLock.Unlock()
+	for owner := range n.nickOwners[nick] {
+		if owner != pid {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) cachedProfile(pid peer.ID) (profileRecord, bool) {
+	val, err := n.Host.Peerstore().Get(pid, profileKey)
+	if err != nil {
+		return profileRecord{}, false
+	}
+	rec, ok := val.(profileRecord)
+	return rec, ok
+}
+
+func (n *Node) handleProfileStream(s network.Stream) {
+	defer s.Close()
+
+	remote := s.Conn().RemotePeer()
+
+	s.SetDeadline(time.Now().Add(15 * time.Second))
+	var rec profileRecord
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&rec); err != nil {
+		s.Reset()
+		return
+	}
+	if err := n.saveProfile(remote, rec); err != nil {
+		n.Cfg.Log.Printf("Invalid profile from %v: %v", remote, err)
+		s.Reset()
+		return
+	}
+
+	if err := json.NewEncoder(s).Encode(n.ownProfile()); err != nil {
+		s.Reset()
+		return
+	}
+}
+
+// exchangeProfile sends our profile record to the peer and saves the record
+// it sends in return.
+func (n *Node) exchangeProfile(pid peer.ID) error {
+	ctx, cancel := context.WithTimeout(n.nodeContext, 15*time.Second)
+	defer cancel()
+
+	s, err := n.Host.NewStream(ctx, pid, ProfileProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	s.SetDeadline(time.Now().Add(15 * time.Second))
+	if err := json.NewEncoder(s).Encode(n.ownProfile()); err != nil {
+		s.Reset()
+		return err
+	}
+
+	var rec profileRecord
+	if err := json.NewDecoder(io.LimitReader(s, 4096)).Decode(&rec); err != nil {
+		s.Reset()
+		return err
+	}
+	return n.saveProfile(pid, rec)
+}
+
+// refreshProfile fetches the peer profile in background if we do not have
+// it or it was not updated for a while.
+func (n *Node) refreshProfile(pid peer.ID) {
+	if pid == n.ID() {
+		return
+	}
+
+	n.profileLock.Lock()
+	last, ok := n.profileFetched[pid]
+	if ok && time.Since(last) < profileRefreshInterval {
+		n.profileLock.Unlock()
+		return
+	}
+	// Set it now so we will not start multiple exchanges at once.
+	n.profileFetched[pid] = time.Now()
+	n.profileLock.Unlock()
+
+	go func() {
+		if err := n.exchangeProfile(pid); err != nil {
+			n.Cfg.Log.Printf("Failed to fetch profile of %v: %v", pid, err)
+		}
+	}()
+}
+
+// Nickname returns the nickname advertised by the peer. Empty string is
+// returned if peer did not set a nickname or we do not know about it.
+func (n *Node) Nickname(pid peer.ID) string {
+	if pid == n.ID() {
+		return n.ownProfile().Nickname
+	}
+	rec, ok := n.cachedProfile(pid)
+	if !ok {
+		return ""
+	}
+	return rec.Nickname
+}
+
+// DisplayName returns the name that should be used to refer to the peer in
+// the UI.
+//
+// It is the petname from the local address book, nickname advertised by the
+// peer or peer ID if there is none. Note that nicknames are not unique and
+// can be picked by anyone, if several known peers use the same nickname,
+// the end of the peer ID is added to it, e.g. "alice~x7Rq2d".
+func (n *Node) DisplayName(pid peer.ID) string {
+	if petname := n.Petname(pid); petname != "" && !isReservedName(petname) {
+		return petname
+	}
+
+	nick := n.Nickname(pid)
+	if nick == "" || isReservedName(nick) {
+		return pid.String()
+	}
+	if pid != n.ID() {
+		// Do not let anybody pretend to be us or one of our contacts.
+		if nick == n.Nickname(n.ID()) {
+			return pid.String()
+		}
+		if _, ok := n.contactByName(nick); ok {
+			return pid.String()
+		}
+		if n.nickShared(nick, pid) {
+			id := pid.String()
+			return nick + nickSuffixSep + id[len(id)-nickSuffixLen:]
+		}
+	}
+	return nick
+}
+
+// LookupName returns the peer that has the specified display name.
+//
+// Display name can be either the peer ID or display name of a known peer, see
+// DisplayName. False is returned if the name is not known or it is used by
+// several peers.
+func (n *Node) LookupName(name string) (peer.ID, bool) {
+	if pid, err := peer.Decode(name); err == nil {
+		return pid, true
+	}
+	if pid, ok := n.contactByName(name); ok {
+		return pid, true
+	}
+
+	var found peer.ID
+	for _, p := range n.Host.Peerstore().PeersWithAddrs() {
+		if p == n.ID() || n.DisplayName(p) != name {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = p
+	}
+	if n.DisplayName(n.ID()) == name {
+		if found != "" {
+			return "", false
+		}
+		found = n.ID()
+	}
+	return found, found != ""
+}
@@ -0,0 +1,34 @@
+package infchat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckNickname(t *testing.T) {
+	cases := []struct {
+		nick string
+		fail bool
+	}{
+		{nick: ""},
+		{nick: "alice"},
+		{nick: "[bob]|away"},
+		{nick: "Local", fail: true},
+		{nick: ".hidden", fail: true},
+		{nick: "alice~x7Rq2d", fail: true},
+		{nick: "with space", fail: true},
+		{nick: strings.Repeat("a", MaxNicknameLen+1), fail: true},
+		// Identity multihash with an empty digest, a valid peer ID.
+		{nick: "11", fail: true},
+	}
+
+	for _, c := range cases {
+		err := CheckNickname(c.nick)
+		if c.fail && err == nil {
+			t.Errorf("%q: expected an error", c.nick)
+		}
+		if !c.fail && err != nil {
+			t.Errorf("%q: unexpected error: %v", c.nick, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package infchat
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Reactions are sent as KindReaction messages referencing the message via
+// Target. Anybody can react to any message, each peer is counted once per
+// reaction. Reactions are aggregated only for recent messages, Node.History
+// returns reactions for all messages in the history.
+
+// MaxReactionLen is the maximum length of the reaction in bytes.
+const MaxReactionLen = 32
+
+var ErrInvalidReaction = errors.New("reaction should be a non-empty string without spaces")
+
+// ReactionCount is the amount of peers that reacted to the message with the
+// same reaction.
+type ReactionCount struct {
+	Reaction string
+	Count    int
+}
+
+func checkReactionText(reaction string) error {
+	if reaction == "" || len(reaction) > MaxReactionLen || !utf8.ValidString(reaction) ||
+		strings.ContainsAny(reaction, " \t\r\n") {
+		return ErrInvalidReaction
+	}
+	return nil
+}
+
+// react records the reaction to the message, adding it to the index if it is
+// not there already.
+func (r *recentMessages) react(target recentMessage, reaction string, reactor peer.ID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rm := r.addLocked(target.ID, target.Channel, target.Sender)
+	if rm.reactions == nil {
+		rm.reactions = map[string]map[peer.ID]struct{}{}
+	}
+	if rm.reactions[reaction] == nil {
+		rm.reactions[reaction] = map[peer.ID]struct{}{}
+	}
+	rm.reactions[reaction][reactor] = struct{}{}
+}
+
+func (r *recentMessages) reactions(id string) map[string]int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rm, ok := r.byID[id]
+	if !ok {
+		return nil
+	}
+	counts := make(map[string]int, len(rm.reactions))
+	for reaction, peers := range rm.reactions {
+		counts[reaction] = len(peers)
+	}
+	return counts
+}
+
+// SortReactions converts counts into the list, most popular reactions first.
+func SortReactions(counts map[string]int) []ReactionCount {
+	res := make([]ReactionCount, 0, len(counts))
+	for reaction, count := range counts {
+		res = append(res, ReactionCount{Reaction: reaction, Count: count})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Reaction < res[j].Reaction
+	})
+	return res
+}
+
+// checkReaction reports whether the received KindReaction message should be
+// honored and records it.
+func (n *Node) checkReaction(msg Message) bool {
+	if msg.Target == "" || checkReactionText(msg.Text) != nil {
+		n.Cfg.Log.Printf("Malformed reaction from %v in %s", msg.Sender, RedactDescriptor(msg.Channel))
+		return false
+	}
+	sender, ok := n.lookupSender(msg.Channel, msg.Target)
+	if !ok {
+		n.Cfg.Log.Printf("Ignoring reaction to unknown message %s from %v", msg.Target, msg.Sender)
+		return false
+	}
+
+	n.recent.react(recentMessage{ID: msg.Target, Channel: msg.Channel, Sender: sender}, msg.Text, msg.Sender)
+	return true
+}
+
+// React adds the reaction to the message in the channel or direct
+// conversation referenced by the descriptor.
+func (n *Node) React(descr, id, reaction string) (*Delivery, error) {
+	if err := checkReactionText(reaction); err != nil {
+		return nil, err
+	}
+	sender, ok := n.lookupSender(descr, id)
+	if !ok {
+		return nil, ErrUnknownMessage
+	}
+
+	d, err := n.PostMessage(descr, Message{
+		Kind:   KindReaction,
+		Target: id,
+		Text:   reaction,
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.recent.react(recentMessage{ID: id, Channel: descr, Sender: sender}, reaction, n.ID())
+	return d, nil
+}
+
+// Reactions returns reactions to the recent message, most popular first.
+func (n *Node) Reactions(id string) []ReactionCount {
+	return SortReactions(n.recent.reactions(id))
+}
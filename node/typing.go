@@ -0,0 +1,170 @@
+package infchat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// TypingState tells whether the peer is composing a message. Values match
+// the IRCv3 typing client tag.
+type TypingState string
+
+const (
+	TypingActive TypingState = "active"
+	TypingPaused TypingState = "paused"
+	TypingDone   TypingState = "done"
+)
+
+const (
+	// TypingActive notifications are not sent more often than that.
+	typingInterval = 3 * time.Second
+
+	// The peer should be considered not typing if no notification was
+	// received within that time after TypingActive or TypingPaused.
+	TypingActiveExpiry = 6 * time.Second
+	TypingPausedExpiry = 30 * time.Second
+)
+
+// TypingEvent is generated when the peer notifies us that it is typing in
+// the channel or direct conversation. These events are never stored in
+// history.
+type TypingEvent struct {
+	Channel string
+	Peer    peer.ID
+	State   TypingState
+}
+
+func (TypingEvent) Type() EventType { return EventTyping }
+
+type typingSent struct {
+	state TypingState
+	at    time.Time
+}
+
+func checkTyping(state TypingState) error {
+	switch state {
+	case TypingActive, TypingPaused, TypingDone:
+		return nil
+	default:
+		return fmt.Errorf("typing: unknown state: %s", state)
+	}
+}
+
+// SetTyping notifies members of the channel or the peer referenced by the
+// descriptor that we are typing.
+//
+// It is meant to be called on each input change. Notifications are
+// rate-limited: TypingActive is sent at most once per 3 seconds and
+// TypingPaused and TypingDone only if they change the state others see.
+// Notifications are sent only to peers we are already connected to and are
+// not retried.
+func (n *Node) SetTyping(descr string, state TypingState) error {
+	if err := checkTyping(state); err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(descr, ChanPrefix):
+		if !n.IsJoined(descr) {
+			return errors.New("typing: not on the channel")
+		}
+	case strings.HasPrefix(descr, DMPrefix):
+		if _, err := DMPeer(descr); err != nil {
+			return fmt.Errorf("typing: %w", err)
+		}
+	default:
+		return errors.New("typing: unknown descriptor type")
+	}
+
+	n.typingLock.Lock()
+	last, ok := n.typingSent[descr]
+	if state == TypingActive {
+		if ok && last.state == TypingActive && time.Since(last.at) < typingInterval {
+			n.typingLock.Unlock()
+			return nil
+		}
+	} else if !ok || last.state == state {
+		n.typingLock.Unlock()
+		return nil
+	}
+	if state == TypingDone {
+		delete(n.typingSent, descr)
+	} else {
+		n.typingSent[descr] = typingSent{state: state, at: time.Now()}
+	}
+	n.typingLock.Unlock()
+
+	payload, err := encodeMessage(Message{
+		ID:        newMessageID(),
+		Timestamp: time.Now(),
+		Kind:      KindTyping,
+		Text:      string(state),
+	})
+	if err != nil {
+		return fmt.Errorf("typing: %w", err)
+	}
+
+	go func() {
+		if err := n.publishEphemeral(descr, payload); err != nil && !errors.Is(err, context.Canceled) {
+			n.Cfg.Log.Printf("Typing notification for %s failed: %v", RedactDescriptor(descr), err)
+		}
+	}()
+	return nil
+}
+
+// resetTyping forgets the typing state we sent to the channel or peer.
+// Recipients stop showing us as typing once they get our message, so there
+// is no need to send TypingDone after it.
+func (n *Node) resetTyping(descr string) {
+	n.typingLock.Lock()
+	delete(n.typingSent, descr)
+	n.typingLock.Unlock()
+}
+
+// publishEphemeral sends the payload to the channel or peer bypassing the
+// outbox. It is silently dropped if there is nobody to receive it right now.
+func (n *Node) publishEphemeral(descr string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(n.nodeContext, typingInterval)
+	defer cancel()
+
+	if strings.HasPrefix(descr, DMPrefix) {
+		pid, err := DMPeer(descr)
+		if err != nil {
+			return err
+		}
+		if pid == n.ID() || n.Host.Network().Connectedness(pid) != network.Connected {
+			return nil
+		}
+		s, err := n.Host.NewStream(ctx, pid, DMProtocol)
+		if err != nil {
+			return err
+		}
+		s.SetWriteDeadline(time.Now().Add(typingInterval))
+		if _, err := s.Write(payload); err != nil {
+			s.Reset()
+			return err
+		}
+		return s.Close()
+	}
+
+	n.pubsubLock.Lock()
+	topic, ok := n.topics[descr]
+	n.pubsubLock.Unlock()
+	if !ok || len(topic.ListPeers()) == 0 {
+		return nil
+	}
+
+	if IsPrivateChannel(descr) {
+		var err error
+		payload, err = sealPayload(descr, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return topic.Publish(ctx, payload)
+}
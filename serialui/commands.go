@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 
 	infchat "github.com/foxcpp/infinitychat/node"
@@ -29,6 +30,20 @@ Note that it might not be possible to send messages immediately, wait for the
 "connected to N peers" message.`,
 			Callback: joinCmd,
 		},
+		"create": {
+			Description: "Create a new end-to-end encrypted channel",
+			FullHelp: `/create <name>
+
+Generates a new secret key and joins the channel. Use /invite to get the join
+string to share with other members. Anybody who knows it can read the channel,
+so send it only over trusted channels (e.g. direct messages).`,
+			Callback: createCmd,
+		},
+		"invite": {
+			Description: "Show the string others can use to join a channel",
+			FullHelp:    `/invite [channel descriptor]`,
+			Callback:    inviteCmd,
+		},
 		"leave": {
 			Description: "Leave a previously joined chat channel",
 			Callback:    leaveCmd,
@@ -55,12 +70,118 @@ Might help to accelerate mesh reconnection in case of nodes falling offline.`,
 			Callback: rejoinCmd,
 		},
 		"msg": {
-			Description: "Send message to a specified channel",
+			Description: "Send message to a specified channel or peer",
 			FullHelp: `/msg <descriptor> <message>
 
-Channel must be joined prior using /join`,
+Channel must be joined prior using /join. Direct messages are sent
+using @<peer ID> descriptor.`,
 			Callback: msgCmd,
 		},
+		"me": {
+			Description: "Send an action message to the current buffer",
+			FullHelp:    `/me <action>`,
+			Callback:    meCmd,
+		},
+		"reply": {
+			Description: "Reply to a message in the current buffer",
+			FullHelp: `/reply <message> <text>
+
+Message is referenced by the number shown next to it (if your UI shows them),
+its ID or a unique prefix of the ID.`,
+			Callback: replyCmd,
+		},
+		"react": {
+			Description: "React to a message in the current buffer",
+			FullHelp: `/react <message> <reaction>
+
+Reaction is an emoji or a short word without spaces. Message is referenced the
+same way as for /reply.`,
+			Callback: reactCmd,
+		},
+		"send": {
+			Description: "Offer a file to a channel or peer",
+			FullHelp: `/send <descriptor> <path>
+
+The file is hashed and offered to members of the channel (or the peer), they
+can download it directly from you using /accept while you are online.`,
+			Callback: sendCmd,
+		},
+		"accept": {
+			Description: "Download the offered file",
+			FullHelp: `/accept <offer>
+
+Offer is the message referenced the same way as for /reply. File is saved to
+the download directory set in the configuration. Interrupted downloads are
+resumed if /accept is used again.`,
+			Callback: acceptCmd,
+		},
+		"attach": {
+			Description: "Send a message with a file attached to the current buffer",
+			FullHelp: `/attach <path> [text]
+
+The file is copied to the attachments directory set in the configuration and
+served to anybody who has the message. Unlike /send, other members can fetch
+it from each other when you are offline.`,
+			Callback: attachCmd,
+		},
+		"fetch": {
+			Description: "Download attachments of a message",
+			FullHelp: `/fetch <message> [number]
+
+Message is referenced the same way as for /reply. Only the attachment with
+the specified number is downloaded if it is set. Attachments are saved to the
+attachments directory set in the configuration.`,
+			Callback: fetchCmd,
+		},
+		"edit": {
+			Description: "Change the text of a message you sent",
+			FullHelp: `/edit <message ID> <new text>
+
+Message ID can be shortened as long as it is unique or replaced with the
+number shown next to the message. Use "last" to edit the
+last message you sent to the current buffer. Other members see the change
+only if they received the original message.`,
+			Callback: editCmd,
+		},
+		"delete": {
+			Description: "Delete a message you sent",
+			FullHelp: `/delete <message ID>
+
+Message ID can be shortened as long as it is unique or replaced with the
+number shown next to the message. Use "last" to delete the
+last message you sent to the current buffer. Note that it is not possible to
+make other members forget the message, it is just hidden by their clients.`,
+			Callback: deleteCmd,
+		},
+		"topic": {
+			Description: "Show or change the channel topic",
+			FullHelp: `/topic [text]
+/topic -d [description]
+/topic -c
+
+Without arguments, the current topic is shown. -d changes the longer channel
+description (or clears it) and -c clears the topic. Channels have no owners,
+any member can change the topic and everybody sees who did it.`,
+			Callback: topicCmd,
+		},
+		"history": {
+			Description: "Show previously received messages",
+			FullHelp: `/history <descriptor> [count] [page]
+
+Show last count (default 20) messages from the local history. Use page
+argument to look further back.`,
+			Callback: historyCmd,
+		},
+		"contact": {
+			Description: "Manage the local address book",
+			FullHelp: `/contact add <petname> <peer>
+/contact remove <petname>
+/contact list
+
+Petnames are private to you and always take precedence over nicknames
+advertised by peers. Use @petname to send direct messages to the contact.`,
+			Callback: contactCmd,
+		},
 		"id": {
 			Description: "Show local node ID",
 			Callback: func(_ UI, _ *infchat.Node, buf string, p []string) {
@@ -68,8 +189,33 @@ Channel must be joined prior using /join`,
 					ui.Msg(buf, "local", "Usage: /id")
 				}
 				ui.Msg(buf, "local", "My ID: %v", node.ID())
+				if nick := node.Nickname(node.ID()); nick != "" {
+					ui.Msg(buf, "local", "My nickname: %v", nick)
+				}
 			},
 		},
+		"nick": {
+			Description: "Change the nickname other peers see",
+			FullHelp: `/nick <nickname>
+
+Change is not persistent, set nickname in the configuration file to keep it
+across restarts. Note that nicknames are not unique, use /stat to see
+the peer ID behind the nickname.`,
+			Callback: nickCmd,
+		},
+		"away": {
+			Description: "Mark yourself as away",
+			FullHelp: `/away [message]
+/away busy [message]
+
+Other peers see the presence state and the message in /stat output and as the
+IRC away status. Use /back to become available again.`,
+			Callback: awayCmd,
+		},
+		"back": {
+			Description: "Remove the away status",
+			Callback:    backCmd,
+		},
 		"peers": {
 			Description: "Show list of connected peers and addresses",
 			Callback:    peersCmd,
@@ -149,7 +295,7 @@ func joinCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		ui.Msg(buf, "local", "Usage: /join <channel descriptor>")
 		return
 	}
-	descriptor, err := infchat.ExpandDescriptor(commandParts[1])
+	descriptor, err := node.ExpandDescriptor(commandParts[1])
 	if err != nil {
 		ui.Error(buf, "local", "Invalid channel descriptor")
 		return
@@ -160,8 +306,54 @@ func joinCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		return
 	}
 
-	ui.Msg(buf, "local", "Joined %s", commandParts[1])
-	ui.SetCurrentBuffer(infchat.DescriptorForDisplay(descriptor))
+	ui.Msg(buf, "local", "Joined %s", infchat.RedactDescriptor(commandParts[1]))
+	ui.SetCurrentBuffer(node.DescriptorForDisplay(descriptor))
+}
+
+func createCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 2 {
+		ui.Msg(buf, "local", "Usage: /create <name>")
+		return
+	}
+	name := strings.TrimPrefix(commandParts[1], "#")
+	if name == "" || strings.Contains(name, ":") {
+		ui.Error(buf, "Invalid channel name")
+		return
+	}
+
+	descriptor := infchat.ChanPrefix + name + ":" + infchat.NewChannelKey()
+	if err := node.JoinChannel(descriptor); err != nil {
+		ui.Error(buf, "Join failed: %v", err)
+		return
+	}
+
+	ui.Msg(buf, "local", "Created private channel #%s, use /invite to get the join string", name)
+	ui.SetCurrentBuffer(node.DescriptorForDisplay(descriptor))
+}
+
+func inviteCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	var target string
+	switch len(commandParts) {
+	case 1:
+		target = buf
+	case 2:
+		target = commandParts[1]
+	default:
+		ui.Msg(buf, "local", "Usage: /invite [channel descriptor]")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(target)
+	if err != nil || !strings.HasPrefix(descriptor, infchat.ChanPrefix) {
+		ui.Error(buf, "Invalid channel descriptor")
+		return
+	}
+
+	if !infchat.IsPrivateChannel(descriptor) {
+		ui.Msg(buf, "local", "%s is a public channel, anybody can join it using:", node.DescriptorForDisplay(descriptor))
+	} else {
+		ui.Msg(buf, "local", "Share this with people you want to join the channel (and nobody else):")
+	}
+	ui.Msg(buf, "local", "/join %s", node.DescriptorForDisplay(descriptor))
 }
 
 func leaveCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
@@ -169,7 +361,7 @@ func leaveCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		ui.Msg(buf, "local", "Usage: /leave <channel descriptor>")
 		return
 	}
-	descriptor, err := infchat.ExpandDescriptor(commandParts[1])
+	descriptor, err := node.ExpandDescriptor(commandParts[1])
 	if err != nil {
 		ui.Error(buf, "local", "Invalid channel descriptor")
 		return
@@ -180,11 +372,11 @@ func leaveCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		return
 	}
 
-	if ui.CurrentBuffer() == infchat.DescriptorForDisplay(descriptor) {
+	if ui.CurrentBuffer() == node.DescriptorForDisplay(descriptor) {
 		ui.SetCurrentBuffer("")
 	}
 
-	ui.Msg(buf, "local", "Left %s", commandParts[1])
+	ui.Msg(buf, "local", "Left %s", infchat.RedactDescriptor(commandParts[1]))
 }
 
 func connectCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
@@ -219,19 +411,518 @@ func msgCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		return
 	}
 	descriptor := commandParts[1]
-	descriptor, err := infchat.ExpandDescriptor(commandParts[1])
+	descriptor, err := node.ExpandDescriptor(commandParts[1])
 	if err != nil {
 		ui.Error(buf, "local", "Invalid channel descriptor")
 		return
 	}
 	msg := strings.Join(commandParts[2:], " ")
 
-	if err := node.Post(descriptor, msg); err != nil {
+	d, err := node.Post(descriptor, msg)
+	if err != nil {
 		ui.Error(buf, "local", "Post failed: %v", err)
 		return
 	}
 
-	ui.Msg(infchat.DescriptorForDisplay(descriptor), node.ID().String(), msg)
+	showOwn(ui, node, node.DescriptorForDisplay(descriptor), d, msg)
+}
+
+func nickCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 2 {
+		ui.Msg(buf, "local", "Usage: /nick <nickname>")
+		return
+	}
+
+	if err := node.SetNickname(commandParts[1]); err != nil {
+		ui.Error(buf, "Nickname change failed: %v", err)
+		return
+	}
+
+	ui.Msg(buf, "local", "You are now known as %s", commandParts[1])
+}
+
+func awayCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	state := infchat.PresenceAway
+	text := commandParts[1:]
+	if len(text) != 0 && strings.ToLower(text[0]) == "busy" {
+		state = infchat.PresenceBusy
+		text = text[1:]
+	}
+
+	if err := node.SetPresence(state, strings.Join(text, " ")); err != nil {
+		ui.Error(buf, "%v", err)
+		return
+	}
+
+	ui.Msg(buf, "local", "You are now marked as %s", state)
+}
+
+func backCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 1 {
+		ui.Msg(buf, "local", "Usage: /back")
+		return
+	}
+
+	if err := node.SetPresence(infchat.PresenceOnline, ""); err != nil {
+		ui.Error(buf, "%v", err)
+		return
+	}
+
+	ui.Msg(buf, "local", "You are no longer marked as away")
+}
+
+func contactCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 2 {
+		ui.Msg(buf, "local", "Usage: /contact add|remove|list")
+		return
+	}
+
+	switch strings.ToLower(commandParts[1]) {
+	case "add":
+		if len(commandParts) != 4 {
+			ui.Msg(buf, "local", "Usage: /contact add <petname> <peer>")
+			return
+		}
+		pid, ok := node.LookupName(strings.TrimPrefix(commandParts[3], "@"))
+		if !ok {
+			ui.Error(buf, "Unknown peer: %s", commandParts[3])
+			return
+		}
+		if err := node.AddContact(commandParts[2], pid); err != nil {
+			ui.Error(buf, "%v", err)
+			return
+		}
+		ui.Msg(buf, "local", "Added %s as %s", pid, commandParts[2])
+	case "remove":
+		if len(commandParts) != 3 {
+			ui.Msg(buf, "local", "Usage: /contact remove <petname>")
+			return
+		}
+		if err := node.RemoveContact(commandParts[2]); err != nil {
+			ui.Error(buf, "%v", err)
+			return
+		}
+		ui.Msg(buf, "local", "Removed %s", commandParts[2])
+	case "list":
+		contacts := node.Contacts()
+		if len(contacts) == 0 {
+			ui.Msg(buf, "local", "Address book is empty")
+			return
+		}
+
+		var msg strings.Builder
+		fmt.Fprintf(&msg, "Contacts:\n")
+		for _, c := range contacts {
+			fmt.Fprintf(&msg, "| %s /p2p/%v", c.Petname, c.Peer)
+			if nick := node.Nickname(c.Peer); nick != "" && nick != c.Petname {
+				fmt.Fprintf(&msg, " (calls themselves %s)", nick)
+			}
+			msg.WriteString("\n")
+		}
+		ui.Msg(buf, "local", "%s", msg.String())
+	default:
+		ui.Msg(buf, "local", "Usage: /contact add|remove|list")
+	}
+}
+
+func meCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 2 {
+		ui.Msg(buf, "local", "Usage: /me <action>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	text := strings.Join(commandParts[1:], " ")
+
+	d, err := node.PostMessage(descriptor, infchat.Message{
+		Kind: infchat.KindAction,
+		Text: text,
+	})
+	if err != nil {
+		ui.Error(buf, "Post failed: %v", err)
+		return
+	}
+
+	showOwn(ui, node, buf, d, "* "+text)
+}
+
+// resolveRef converts the message reference used in commands into the
+// message ID.
+func resolveRef(ui UI, node *infchat.Node, descr, ref string) (string, error) {
+	if rui, ok := ui.(RefUI); ok {
+		if id, ok := rui.ResolveRef(ref); ok {
+			return id, nil
+		}
+	}
+	if strings.ToLower(ref) == "last" {
+		id, ok := node.LastOwnMessage(descr)
+		if !ok {
+			return "", errors.New("no messages sent recently")
+		}
+		return id, nil
+	}
+	return node.ResolveMessageID(descr, ref)
+}
+
+func replyCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 3 {
+		ui.Msg(buf, "local", "Usage: /reply <message> <text>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	id, err := resolveRef(ui, node, descriptor, commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Reply failed: %v", err)
+		return
+	}
+	text := strings.Join(commandParts[2:], " ")
+
+	d, err := node.Reply(descriptor, id, text)
+	if err != nil {
+		ui.Error(buf, "Reply failed: %v", err)
+		return
+	}
+
+	showOwn(ui, node, buf, d, text)
+}
+
+func reactCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 3 {
+		ui.Msg(buf, "local", "Usage: /react <message> <reaction>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	id, err := resolveRef(ui, node, descriptor, commandParts[1])
+	if err != nil {
+		ui.Error(buf, "React failed: %v", err)
+		return
+	}
+
+	if _, err := node.React(descriptor, id, commandParts[2]); err != nil {
+		ui.Error(buf, "React failed: %v", err)
+		return
+	}
+
+	showReaction(ui, node, buf, node.DisplayName(node.ID()), id, commandParts[2])
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func sendCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 3 {
+		ui.Msg(buf, "local", "Usage: /send <descriptor> <path>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Invalid descriptor: %v", err)
+		return
+	}
+	path := strings.Join(commandParts[2:], " ")
+
+	// Hashing might take a while for big files.
+	go func() {
+		d, err := node.OfferFile(descriptor, path)
+		if err != nil {
+			ui.Error(buf, "Send failed: %v", err)
+			return
+		}
+		file := d.Message.File
+		showOwn(ui, node, node.DescriptorForDisplay(descriptor), d,
+			fmt.Sprintf("* offers %s (%s)", file.Name, formatSize(file.Size)))
+	}()
+}
+
+func acceptCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 2 {
+		ui.Msg(buf, "local", "Usage: /accept <offer>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	id, err := resolveRef(ui, node, descriptor, commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Accept failed: %v", err)
+		return
+	}
+	info, _, err := node.FileOffer(descriptor, id)
+	if err != nil {
+		ui.Error(buf, "Accept failed: %v", err)
+		return
+	}
+
+	ui.Msg(buf, "local", "Downloading %s (%s)...", info.Name, formatSize(info.Size))
+	go func() {
+		lastStep := 0
+		path, err := node.DownloadFile(node.Context(), descriptor, id, func(done, total int64) {
+			if total == 0 {
+				return
+			}
+			// Report every 10%.
+			step := int(done * 10 / total)
+			if step == lastStep || step == 10 {
+				return
+			}
+			lastStep = step
+			ui.Msg(buf, "local", "Downloading %s: %d%% (%s of %s)", info.Name, step*10,
+				formatSize(done), formatSize(total))
+		})
+		if err != nil {
+			ui.Error(buf, "Download of %s failed: %v", info.Name, err)
+			return
+		}
+		ui.Msg(buf, "local", "Downloaded %s to %s", info.Name, path)
+	}()
+}
+
+func attachCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 2 {
+		ui.Msg(buf, "local", "Usage: /attach <path> [text]")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	path := commandParts[1]
+	text := strings.Join(commandParts[2:], " ")
+
+	// Copying might take a while for big files.
+	go func() {
+		d, err := node.PostAttachment(descriptor, path, text)
+		if err != nil {
+			ui.Error(buf, "Attach failed: %v", err)
+			return
+		}
+		showOwn(ui, node, buf, d, d.Message.Text)
+		showAttachments(ui, buf, d.Message.ID, d.Message.Attachments)
+	}()
+}
+
+func fetchCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 2 && len(commandParts) != 3 {
+		ui.Msg(buf, "local", "Usage: /fetch <message> [number]")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	id, err := resolveRef(ui, node, descriptor, commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Fetch failed: %v", err)
+		return
+	}
+	infos, _, err := node.Attachments(descriptor, id)
+	if err != nil {
+		ui.Error(buf, "Fetch failed: %v", err)
+		return
+	}
+	if len(infos) == 0 {
+		ui.Error(buf, "Fetch failed: message has no attachments")
+		return
+	}
+	if len(commandParts) == 3 {
+		i, err := strconv.Atoi(commandParts[2])
+		if err != nil || i <= 0 || i > len(infos) {
+			ui.Error(buf, "Fetch failed: invalid attachment number")
+			return
+		}
+		infos = infos[i-1 : i]
+	}
+
+	for _, info := range infos {
+		info := info
+		ui.Msg(buf, "local", "Fetching %s (%s)...", info.Name, formatSize(info.Size))
+		go func() {
+			path, err := node.FetchAttachment(node.Context(), descriptor, id, info.Hash, nil)
+			if err != nil {
+				ui.Error(buf, "Fetch of %s failed: %v", info.Name, err)
+				return
+			}
+			ui.Msg(buf, "local", "Fetched %s to %s", info.Name, path)
+		}()
+	}
+}
+
+func topicCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil || !strings.HasPrefix(descriptor, infchat.ChanPrefix) {
+		ui.Error(buf, "Topic can be set only for channels")
+		return
+	}
+	meta, ok := node.ChannelMeta(descriptor)
+
+	if len(commandParts) == 1 {
+		if !ok || meta.Topic == "" {
+			ui.Msg(buf, "local", "No topic is set")
+			return
+		}
+		ui.Msg(buf, "local", "Topic: %s", meta.Topic)
+		ui.Msg(buf, "local", "Set by %s at %s", node.DisplayName(meta.Author),
+			meta.Updated.Format("2006-01-02 15:04:05"))
+		return
+	}
+
+	topic, description := meta.Topic, meta.Description
+	switch commandParts[1] {
+	case "-c":
+		if len(commandParts) != 2 {
+			ui.Msg(buf, "local", "Usage: /topic -c")
+			return
+		}
+		topic = ""
+	case "-d":
+		description = strings.Join(commandParts[2:], " ")
+	default:
+		topic = strings.Join(commandParts[1:], " ")
+	}
+
+	if _, err := node.SetChannelMeta(descriptor, topic, description); err != nil {
+		ui.Error(buf, "Topic change failed: %v", err)
+		return
+	}
+}
+
+func editCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 3 {
+		ui.Msg(buf, "local", "Usage: /edit <message ID> <new text>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	id, err := resolveRef(ui, node, descriptor, commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Edit failed: %v", err)
+		return
+	}
+	text := strings.Join(commandParts[2:], " ")
+
+	if _, err := node.EditMessage(descriptor, id, text); err != nil {
+		ui.Error(buf, "Edit failed: %v", err)
+		return
+	}
+
+	if mui, ok := ui.(MessageUI); ok {
+		mui.EditMsg(buf, node.DisplayName(node.ID()), id, text)
+		return
+	}
+	ui.Msg(buf, "local", "Message %s edited", id)
+}
+
+func deleteCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) != 2 {
+		ui.Msg(buf, "local", "Usage: /delete <message ID>")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(buf)
+	if err != nil {
+		ui.Error(buf, "Invalid buffer: %v", err)
+		return
+	}
+	id, err := resolveRef(ui, node, descriptor, commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Delete failed: %v", err)
+		return
+	}
+
+	if _, err := node.DeleteMessage(descriptor, id); err != nil {
+		ui.Error(buf, "Delete failed: %v", err)
+		return
+	}
+
+	if mui, ok := ui.(MessageUI); ok {
+		mui.DeleteMsg(buf, node.DisplayName(node.ID()), id)
+		return
+	}
+	ui.Msg(buf, "local", "Message %s deleted", id)
+}
+
+func historyCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
+	if len(commandParts) < 2 || len(commandParts) > 4 {
+		ui.Msg(buf, "local", "Usage: /history <descriptor> [count] [page]")
+		return
+	}
+	descriptor, err := node.ExpandDescriptor(commandParts[1])
+	if err != nil {
+		ui.Error(buf, "Invalid descriptor")
+		return
+	}
+
+	count, page := 20, 1
+	if len(commandParts) >= 3 {
+		count, err = strconv.Atoi(commandParts[2])
+		if err != nil || count <= 0 {
+			ui.Error(buf, "Invalid count")
+			return
+		}
+	}
+	if len(commandParts) == 4 {
+		page, err = strconv.Atoi(commandParts[3])
+		if err != nil || page <= 0 {
+			ui.Error(buf, "Invalid page number")
+			return
+		}
+	}
+
+	msgs, err := node.History(descriptor, infchat.HistoryQuery{
+		Limit:  count,
+		Offset: count * (page - 1),
+	})
+	if err != nil {
+		ui.Error(buf, "%v", err)
+		return
+	}
+	if len(msgs) == 0 {
+		ui.Msg(buf, "local", "No messages")
+		return
+	}
+
+	ui.Msg(buf, "local", "History of %s, page %d:", infchat.RedactDescriptor(node.DescriptorForDisplay(descriptor)), page)
+	for _, msg := range msgs {
+		edited := ""
+		if msg.Edited {
+			edited = " (edited)"
+		}
+		for _, rc := range infchat.SortReactions(msg.Reactions) {
+			edited += fmt.Sprintf(" %s %d", rc.Reaction, rc.Count)
+		}
+		sender := node.DisplayName(msg.Sender)
+		if msg.Unverified {
+			sender += " via " + node.DisplayName(msg.RelayedBy)
+		}
+		ui.Msg(buf, sender, "[%s] %s%s%s", msg.Timestamp.Format("2006-01-02 15:04:05"), replyPrefix(msg.ReplyTo), msg.Text, edited)
+	}
 }
 
 func rejoinCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
@@ -241,7 +932,7 @@ func rejoinCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		case 1:
 			err = node.RejoinAll()
 		case 2:
-			descriptor, err := infchat.ExpandDescriptor(commandParts[1])
+			descriptor, err := node.ExpandDescriptor(commandParts[1])
 			if err != nil {
 				ui.Error(buf, "local", "%v", err)
 				return
@@ -264,7 +955,7 @@ func announceCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		case 1:
 			err = node.AnnounceAll()
 		case 2:
-			descriptor, err := infchat.ExpandDescriptor(commandParts[1])
+			descriptor, err := node.ExpandDescriptor(commandParts[1])
 			if err != nil {
 				ui.Error(buf, "%v", err)
 				return
@@ -299,7 +990,7 @@ func statCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
 		ui.Msg(buf, "local", "Usage: /stat <descriptor>")
 		return
 	}
-	descriptor, err := infchat.ExpandDescriptor(commandParts[1])
+	descriptor, err := node.ExpandDescriptor(commandParts[1])
 	if err != nil {
 		ui.Error(buf, "local", "Invalid descriptor")
 		return
@@ -343,6 +1034,19 @@ func statPeer(ui UI, node *infchat.Node, buf string, peerID peer.ID) {
 	var msg strings.Builder
 
 	fmt.Fprintf(&msg, "Peer /p2p/%v\n", peerID)
+	if petname := node.Petname(peerID); petname != "" {
+		fmt.Fprintf(&msg, " Petname: %s\n", petname)
+	}
+	if nick := node.Nickname(peerID); nick != "" {
+		fmt.Fprintf(&msg, " Nickname: %s\n", nick)
+	}
+	if p, ok := node.Presence(peerID); ok {
+		if p.Text != "" {
+			fmt.Fprintf(&msg, " Presence: %s (%s)\n", p.State, p.Text)
+		} else {
+			fmt.Fprintf(&msg, " Presence: %s\n", p.State)
+		}
+	}
 	info := node.Host.Peerstore().PeerInfo(peerID)
 	if len(info.Addrs) == 0 {
 		fmt.Fprintf(&msg, " Unknown peer\n")
@@ -386,14 +1090,33 @@ func statPeer(ui UI, node *infchat.Node, buf string, peerID peer.ID) {
 func statChannel(ui UI, node *infchat.Node, buf string, desc string) {
 	var msg strings.Builder
 
-	fmt.Fprintf(&msg, "Channel %s\n", infchat.DescriptorForDisplay(desc))
-	fmt.Fprintf(&msg, " Full descriptor: %s\n", desc)
+	fmt.Fprintf(&msg, "Channel %s\n", infchat.RedactDescriptor(desc))
+	if infchat.IsPrivateChannel(desc) {
+		redacted := infchat.ChanPrefix + strings.TrimPrefix(infchat.RedactDescriptor(desc), "#")
+		fmt.Fprintf(&msg, " Full descriptor: %s (use /invite to see the key)\n", redacted)
+	} else {
+		fmt.Fprintf(&msg, " Full descriptor: %s\n", desc)
+	}
 	fmt.Fprintf(&msg, " We are member: %s\n", boolStr[node.IsJoined(desc)])
+	fmt.Fprintf(&msg, " End-to-end encrypted: %s\n", boolStr[infchat.IsPrivateChannel(desc)])
+	if infchat.IsPrivateChannel(desc) {
+		fmt.Fprintf(&msg, " Pubsub topic: %s\n", infchat.TopicName(desc))
+	}
+	if meta, ok := node.ChannelMeta(desc); ok {
+		fmt.Fprintf(&msg, " Topic: %s\n", meta.Topic)
+		if meta.Description != "" {
+			fmt.Fprintf(&msg, " Description: %s\n", meta.Description)
+		}
+		fmt.Fprintf(&msg, " Created by: %s /p2p/%v at %s\n", node.DisplayName(meta.Creator),
+			meta.Creator, meta.Created.Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(&msg, " Changed by: %s /p2p/%v at %s\n", node.DisplayName(meta.Author),
+			meta.Author, meta.Updated.Format("2006-01-02 15:04:05"))
+	}
 	peers := node.ConnectedMembers(desc)
 	if len(peers) != 0 {
 		fmt.Fprintf(&msg, "Connected members:\n")
 		for _, p := range peers {
-			fmt.Fprintf(&msg, "| /p2p/%v", p)
+			fmt.Fprintf(&msg, "| %s /p2p/%v\n", node.DisplayName(p), p)
 		}
 	}
 
@@ -401,7 +1124,24 @@ func statChannel(ui UI, node *infchat.Node, buf string, desc string) {
 }
 
 func statDM(ui UI, node *infchat.Node, buf, desc string) {
-	ui.Msg(buf, "local", "Not implemented yet")
+	pid, err := infchat.DMPeer(desc)
+	if err != nil {
+		ui.Error(buf, "Invalid DM descriptor: %v", err)
+		return
+	}
+
+	var msg strings.Builder
+
+	fmt.Fprintf(&msg, "Direct conversation %s\n", node.DescriptorForDisplay(desc))
+	fmt.Fprintf(&msg, " Full descriptor: %s\n", desc)
+	fmt.Fprintf(&msg, " Connected: %s\n", boolStr[node.IsConnected(pid)])
+	protos, err := node.Host.Peerstore().SupportsProtocols(pid, string(infchat.DMProtocol))
+	if err == nil {
+		fmt.Fprintf(&msg, " Known to support DMs: %s\n", boolStr[len(protos) != 0])
+	}
+	ui.Msg(buf, "local", "%s", msg.String())
+
+	statPeer(ui, node, buf, pid)
 }
 
 func pingCmd(ui UI, node *infchat.Node, buf string, commandParts []string) {
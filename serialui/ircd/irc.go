@@ -14,9 +14,34 @@ import (
 	"gopkg.in/irc.v3"
 )
 
+// IRCv3 capabilities supported by the gateway.
+var supportedCaps = []string{"message-tags", "draft/message-redaction"}
+
+type capSet struct {
+	lock    sync.Mutex
+	enabled map[string]bool
+}
+
+func (cs *capSet) has(name string) bool {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return cs.enabled[name]
+}
+
+func (cs *capSet) list() []string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	res := make([]string, 0, len(cs.enabled))
+	for name := range cs.enabled {
+		res = append(res, name)
+	}
+	return res
+}
+
 type conn struct {
 	*irc.Conn
-	Net net.Conn
+	Net  net.Conn
+	Caps *capSet
 }
 
 type UI struct {
@@ -98,6 +123,7 @@ func (ui *UI) handleConn(netConn net.Conn) {
 	c := conn{
 		Conn: irc.NewConn(netConn),
 		Net:  netConn,
+		Caps: &capSet{enabled: map[string]bool{}},
 	}
 	defer c.Net.Close()
 	connID := c.Net.RemoteAddr().String()
@@ -106,9 +132,16 @@ func (ui *UI) handleConn(netConn net.Conn) {
 		Name: "infinitychat.invalid",
 	}
 	clPrefix := &irc.Prefix{
-		Name: ui.Node.ID().String(),
+		Name: ui.Node.DisplayName(ui.Node.ID()),
 	}
 
+	// Registration is postponed until CAP END if client started capability
+	// negotiation.
+	var (
+		negotiating bool
+		userSent    bool
+	)
+
 	errors := 0
 	for {
 		msg, err := c.ReadMessage()
@@ -132,56 +165,45 @@ func (ui *UI) handleConn(netConn net.Conn) {
 		switch msg.Command {
 		case "NICK":
 			// No-op, we don't care about nickname client uses.
+		case "CAP":
+			switch ui.handleCap(c, servPrefix, msg) {
+			case "LS", "REQ":
+				negotiating = true
+			case "END":
+				if negotiating && userSent {
+					ui.welcome(c, connID, servPrefix, clPrefix)
+				}
+				negotiating = false
+			}
 		case "USER":
-			// Complete IRC "registration" dance.
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "001",
-				Params:  []string{clPrefix.Name, "Welcome, idiot"},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "002",
-				Params:  []string{"InfinityChat node version 0.1"},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "004",
-				Params:  []string{"infinitychat.invalid", "infchat", "v0.1", "", ""},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "005",
-				Params:  []string{"CHANTYPES=#", "NETWORK=infchat", "CASEMAPPING=rfc1459" /* lie */, "CHARSET=ascii", "NICKLEN=256", "CHANNELLEN=512", "TOPICLEN=1" /* also lie */},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "251",
-				Params:  []string{strconv.Itoa(len(ui.Node.Host.Network().Conns())), "connected peers"},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "252",
-				Params:  []string{strconv.Itoa(len(ui.conns)), "clients connected to IRC gateway"},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "254",
-				Params: []string{
-					strconv.Itoa(len(ui.Node.PubsubProto.GetTopics())),
-					"pubsub subscriptions",
-				},
-			})
-			c.WriteMessage(&irc.Message{
-				Prefix:  servPrefix,
-				Command: "422",
-				Params: []string{
-					"no MOTD for you",
-				},
-			})
-			ui.connsLck.Lock()
-			ui.conns[connID] = c
-			ui.connsLck.Unlock()
+			userSent = true
+			if !negotiating {
+				ui.welcome(c, connID, servPrefix, clPrefix)
+			}
+		case "REDACT":
+			if len(msg.Params) < 2 {
+				break
+			}
+			ui.lines <- struct{ buf, line string }{
+				buf:  ui.bufferFor(msg.Params[0]),
+				line: "/delete " + msg.Params[1],
+			}
+		case "TAGMSG":
+			if len(msg.Params) < 1 {
+				break
+			}
+			if typing, ok := msg.GetTag("+typing"); ok {
+				ui.setTyping(msg.Params[0], infchat.TypingState(typing))
+			}
+			reaction, hasReaction := msg.GetTag("+draft/react")
+			replyTo, hasReply := msg.GetTag("+draft/reply")
+			if !hasReaction || !hasReply {
+				break
+			}
+			ui.lines <- struct{ buf, line string }{
+				buf:  ui.bufferFor(msg.Params[0]),
+				line: "/react " + replyTo + " " + reaction,
+			}
 		case "PRIVMSG":
 			if msg.Params[0] == "local" {
 				ui.lines <- struct{ buf, line string }{
@@ -189,9 +211,39 @@ func (ui *UI) handleConn(netConn net.Conn) {
 					line: "/" + msg.Params[1],
 				}
 			} else {
+				target := msg.Params[0]
+				if !strings.HasPrefix(target, "#") {
+					// Target is a nickname, so this is a direct message.
+					pid, ok := ui.Node.LookupName(target)
+					if ok {
+						if p, ok := ui.Node.Presence(pid); ok && p.State != infchat.PresenceOnline {
+							awayMsg := p.Text
+							if awayMsg == "" {
+								awayMsg = string(p.State)
+							}
+							c.WriteMessage(&irc.Message{
+								Prefix:  servPrefix,
+								Command: "301",
+								Params:  []string{clPrefix.Name, msg.Params[0], awayMsg},
+							})
+						}
+						target = "@" + pid.String()
+					} else {
+						target = "@" + target
+					}
+				}
+				if replyTo, ok := msg.GetTag("+draft/reply"); ok && replyTo != "" {
+					// Command is executed in the target buffer so errors
+					// will be shown there.
+					ui.lines <- struct{ buf, line string }{
+						buf:  target,
+						line: "/reply " + replyTo + " " + msg.Params[1],
+					}
+					break
+				}
 				ui.lines <- struct{ buf, line string }{
 					buf:  "irc_conn:" + connID,
-					line: "/msg " + msg.Params[0] + " " + msg.Params[1],
+					line: "/msg " + target + " " + msg.Params[1],
 				}
 			}
 		case "JOIN":
@@ -210,21 +262,41 @@ func (ui *UI) handleConn(netConn net.Conn) {
 				Command: "JOIN",
 				Params:  []string{msg.Params[0]},
 			})
+			// Metadata of the channel we just joined is usually not known
+			// yet, TOPIC is sent once it is received.
+			ui.sendTopic(c, servPrefix, clPrefix.Name, msg.Params[0], false)
 			fallthrough
 		case "NAMES":
-			descr, err := infchat.ExpandDescriptor(msg.Params[0])
+			descr, err := ui.Node.ExpandDescriptor(msg.Params[0])
 			if err != nil {
 				// what do I do...
 			}
-			members := []string{ui.Node.ID().String()}
+			members := []string{ui.Node.DisplayName(ui.Node.ID())}
 			for _, peer := range ui.Node.ConnectedMembers(descr) {
-				members = append(members, peer.String())
+				members = append(members, ui.Node.DisplayName(peer))
 			}
 			c.WriteMessage(&irc.Message{
 				Prefix:  servPrefix,
 				Command: "353",
 				Params:  []string{clPrefix.Name, "=", msg.Params[0], strings.Join(members, " ")},
 			})
+		case "TOPIC":
+			if len(msg.Params) < 1 {
+				break
+			}
+			if len(msg.Params) == 1 {
+				ui.sendTopic(c, servPrefix, clPrefix.Name, msg.Params[0], true)
+				break
+			}
+			line := "/topic " + msg.Params[1]
+			if msg.Params[1] == "" {
+				line = "/topic -c"
+			}
+			// Executed in the channel buffer so errors are shown there.
+			ui.lines <- struct{ buf, line string }{
+				buf:  ui.bufferFor(msg.Params[0]),
+				line: line,
+			}
 		case "PART":
 			ui.lines <- struct{ buf, line string }{
 				buf:  "irc_conn:" + connID,
@@ -238,6 +310,28 @@ func (ui *UI) handleConn(netConn net.Conn) {
 				Command: "PART",
 				Params:  []string{msg.Params[0]},
 			})
+		case "AWAY":
+			if len(msg.Params) == 0 || msg.Params[0] == "" {
+				ui.lines <- struct{ buf, line string }{
+					buf:  "irc_conn:" + connID,
+					line: "/back",
+				}
+				c.WriteMessage(&irc.Message{
+					Prefix:  servPrefix,
+					Command: "305",
+					Params:  []string{clPrefix.Name, "You are no longer marked as being away"},
+				})
+			} else {
+				ui.lines <- struct{ buf, line string }{
+					buf:  "irc_conn:" + connID,
+					line: "/away " + msg.Params[0],
+				}
+				c.WriteMessage(&irc.Message{
+					Prefix:  servPrefix,
+					Command: "306",
+					Params:  []string{clPrefix.Name, "You have been marked as being away"},
+				})
+			}
 		case "PING":
 			c.WriteMessage(&irc.Message{
 				Prefix:  servPrefix,
@@ -269,6 +363,169 @@ func (ui *UI) handleConn(netConn net.Conn) {
 	}
 }
 
+// sendTopic sends RPL_TOPIC and RPL_TOPICWHOTIME for the channel. If the
+// topic is not set, RPL_NOTOPIC is sent only if noTopic is true.
+func (ui *UI) sendTopic(c conn, servPrefix *irc.Prefix, client, channel string, noTopic bool) {
+	var (
+		meta infchat.ChannelMeta
+		ok   bool
+	)
+	if descr, err := ui.Node.ExpandDescriptor(channel); err == nil {
+		meta, ok = ui.Node.ChannelMeta(descr)
+	}
+	if !ok || meta.Topic == "" {
+		if noTopic {
+			c.WriteMessage(&irc.Message{
+				Prefix:  servPrefix,
+				Command: "331",
+				Params:  []string{client, channel, "No topic is set"},
+			})
+		}
+		return
+	}
+
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "332",
+		Params:  []string{client, channel, meta.Topic},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "333",
+		Params: []string{client, channel, ui.Node.DisplayName(meta.Author),
+			strconv.FormatInt(meta.Updated.Unix(), 10)},
+	})
+}
+
+// bufferFor converts the IRC message target into the buffer name. Commands
+// executed in the target buffer show errors there.
+func (ui *UI) bufferFor(target string) string {
+	if strings.HasPrefix(target, "#") {
+		return target
+	}
+	if pid, ok := ui.Node.LookupName(target); ok {
+		return "@" + pid.String()
+	}
+	return "@" + target
+}
+
+// welcome completes IRC "registration" dance.
+func (ui *UI) welcome(c conn, connID string, servPrefix, clPrefix *irc.Prefix) {
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "001",
+		Params:  []string{clPrefix.Name, "Welcome, idiot"},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "002",
+		Params:  []string{"InfinityChat node version 0.1"},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "004",
+		Params:  []string{"infinitychat.invalid", "infchat", "v0.1", "", ""},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "005",
+		Params:  []string{"CHANTYPES=#", "NETWORK=infchat", "CASEMAPPING=rfc1459" /* lie */, "CHARSET=ascii", "NICKLEN=256", "CHANNELLEN=512", "TOPICLEN=" + strconv.Itoa(infchat.MaxTopicLen), "AWAYLEN=" + strconv.Itoa(infchat.MaxStatusTextLen)},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "251",
+		Params:  []string{strconv.Itoa(len(ui.Node.Host.Network().Conns())), "connected peers"},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "252",
+		Params:  []string{strconv.Itoa(len(ui.conns)), "clients connected to IRC gateway"},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "254",
+		Params: []string{
+			strconv.Itoa(len(ui.Node.PubsubProto.GetTopics())),
+			"pubsub subscriptions",
+		},
+	})
+	c.WriteMessage(&irc.Message{
+		Prefix:  servPrefix,
+		Command: "422",
+		Params: []string{
+			"no MOTD for you",
+		},
+	})
+	ui.connsLck.Lock()
+	ui.conns[connID] = c
+	ui.connsLck.Unlock()
+}
+
+// handleCap implements IRCv3 capability negotiation. It returns the
+// subcommand.
+func (ui *UI) handleCap(c conn, servPrefix *irc.Prefix, msg *irc.Message) string {
+	if len(msg.Params) == 0 {
+		return ""
+	}
+	subcmd := strings.ToUpper(msg.Params[0])
+
+	reply := func(params ...string) {
+		c.WriteMessage(&irc.Message{
+			Prefix:  servPrefix,
+			Command: "CAP",
+			Params:  append([]string{"*", subcmd}, params...),
+		})
+	}
+
+	switch subcmd {
+	case "LS":
+		reply(strings.Join(supportedCaps, " "))
+	case "LIST":
+		reply(strings.Join(c.Caps.list(), " "))
+	case "REQ":
+		if len(msg.Params) < 2 {
+			break
+		}
+		requested := strings.Fields(msg.Params[1])
+		for _, name := range requested {
+			if !isSupportedCap(strings.TrimPrefix(name, "-")) {
+				c.WriteMessage(&irc.Message{
+					Prefix:  servPrefix,
+					Command: "CAP",
+					Params:  []string{"*", "NAK", msg.Params[1]},
+				})
+				return subcmd
+			}
+		}
+
+		c.Caps.lock.Lock()
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(c.Caps.enabled, strings.TrimPrefix(name, "-"))
+			} else {
+				c.Caps.enabled[name] = true
+			}
+		}
+		c.Caps.lock.Unlock()
+
+		c.WriteMessage(&irc.Message{
+			Prefix:  servPrefix,
+			Command: "CAP",
+			Params:  []string{"*", "ACK", msg.Params[1]},
+		})
+	}
+	return subcmd
+}
+
+func isSupportedCap(name string) bool {
+	for _, supported := range supportedCaps {
+		if name == supported {
+			return true
+		}
+	}
+	return false
+}
+
 func (ui *UI) msg(buffer, sender string, format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
 	lines := strings.Split(msg, "\n")
@@ -278,10 +535,16 @@ func (ui *UI) msg(buffer, sender string, format string, args ...interface{}) {
 }
 
 func (ui *UI) msgLine(buffer, sender, line string) {
+	ui.sendLine(buffer, sender, "PRIVMSG", line, "", "")
+}
+
+// sendLine sends the line to all clients interested in the buffer. msgID and
+// replyTo are attached as tags for clients that support them.
+func (ui *UI) sendLine(buffer, sender, command, line, msgID, replyTo string) {
 	if buffer == "" {
 		return
 	}
-	if sender == ui.Node.ID().String() {
+	if sender == ui.Node.DisplayName(ui.Node.ID()) {
 		return
 	}
 
@@ -310,36 +573,206 @@ func (ui *UI) msgLine(buffer, sender, line string) {
 		return
 	}
 
-	if buffer == "" {
-		for _, conn := range ui.joined[buffer] {
-			conn.Net.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			conn.WriteMessage(&irc.Message{
-				Prefix: &irc.Prefix{
-					Name: sender,
-				},
-				Command: "PRIVMSG",
-				Params:  []string{line},
-			})
-			conn.Net.SetWriteDeadline(time.Time{})
+	conns, target := ui.targets(buffer)
+	for connID, c := range conns {
+		ui.write(buffer, connID, c, &irc.Message{
+			Tags: msgTags(c, msgID, replyTo),
+			Prefix: &irc.Prefix{
+				Name: sender,
+			},
+			Command: command,
+			Params:  []string{target, line},
+		})
+	}
+}
+
+// targets returns connections that should receive messages for the buffer
+// and the message target to use. connsLck should be held.
+func (ui *UI) targets(buffer string) (map[string]conn, string) {
+	if strings.HasPrefix(buffer, "@") {
+		// Direct messages are sent to all clients as if they were sent to us.
+		return ui.conns, ui.Node.DisplayName(ui.Node.ID())
+	}
+	return ui.joined[buffer], buffer
+}
+
+// write sends the message to the client and drops the connection if that
+// fails. connsLck should be held.
+func (ui *UI) write(buffer, connID string, c conn, msg *irc.Message) {
+	c.Net.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err := c.WriteMessage(msg)
+	if err != nil {
+		c.Net.Close()
+		delete(ui.joined[buffer], connID)
+		delete(ui.conns, connID)
+		ui.Log.Printf("IRC: I/O error, dropped connection %s: %v", connID, err)
+	}
+	c.Net.SetWriteDeadline(time.Time{})
+}
+
+func msgTags(c conn, msgID, replyTo string) irc.Tags {
+	if !c.Caps.has("message-tags") {
+		return nil
+	}
+	tags := irc.Tags{}
+	if msgID != "" {
+		tags["msgid"] = irc.TagValue(msgID)
+	}
+	if replyTo != "" {
+		tags["+draft/reply"] = irc.TagValue(replyTo)
+	}
+	return tags
+}
+
+func (ui *UI) ChatMsg(buffer, sender, msgID, replyTo, text string) {
+	// All lines share the ID so REDACT removes the whole message.
+	for _, line := range strings.Split(text, "\n") {
+		ui.sendLine(buffer, sender, "PRIVMSG", line, msgID, replyTo)
+	}
+}
+
+func (ui *UI) EditMsg(buffer, sender, msgID, text string) {
+	// There is no way to change the message in IRC, so just tell about it.
+	ui.sendLine(buffer, sender, "NOTICE", "(edited) "+strings.Replace(text, "\n", " ", -1), "", msgID)
+}
+
+func (ui *UI) Reacted(buffer, sender, msgID, reaction string, counts []infchat.ReactionCount) {
+	if buffer == "" || sender == ui.Node.DisplayName(ui.Node.ID()) {
+		return
+	}
+
+	ui.connsLck.Lock()
+	defer ui.connsLck.Unlock()
+
+	conns, target := ui.targets(buffer)
+	for connID, c := range conns {
+		msg := &irc.Message{
+			Prefix: &irc.Prefix{
+				Name: sender,
+			},
 		}
+		if c.Caps.has("message-tags") {
+			msg.Tags = irc.Tags{
+				"+draft/react": irc.TagValue(reaction),
+				"+draft/reply": irc.TagValue(msgID),
+			}
+			msg.Command = "TAGMSG"
+			msg.Params = []string{target}
+		} else {
+			msg.Command = "NOTICE"
+			msg.Params = []string{target, "(reacted with " + reaction + " to message " + msgID + ")"}
+		}
+		ui.write(buffer, connID, c, msg)
 	}
+}
 
-	for connID, c := range ui.joined[buffer] {
-		c.Net.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		err := c.WriteMessage(&irc.Message{
+// setTyping passes the typing notification from the client to the target.
+func (ui *UI) setTyping(target string, state infchat.TypingState) {
+	descr, err := ui.Node.ExpandDescriptor(ui.bufferFor(target))
+	if err != nil {
+		return
+	}
+	if err := ui.Node.SetTyping(descr, state); err != nil {
+		ui.Log.Printf("IRC: typing notification for %s: %v", target, err)
+	}
+}
+
+// Typing sends the notification as the +typing client tag to clients that
+// support message tags.
+func (ui *UI) Typing(buffer, sender string, state infchat.TypingState) {
+	if buffer == "" || sender == ui.Node.DisplayName(ui.Node.ID()) {
+		return
+	}
+
+	ui.connsLck.Lock()
+	defer ui.connsLck.Unlock()
+
+	conns, target := ui.targets(buffer)
+	for connID, c := range conns {
+		if !c.Caps.has("message-tags") {
+			continue
+		}
+		ui.write(buffer, connID, c, &irc.Message{
+			Tags: irc.Tags{
+				"+typing": irc.TagValue(state),
+			},
 			Prefix: &irc.Prefix{
 				Name: sender,
 			},
-			Command: "PRIVMSG",
-			Params:  []string{buffer, line},
+			Command: "TAGMSG",
+			Params:  []string{target},
 		})
-		if err != nil {
-			c.Net.Close()
-			delete(ui.joined[buffer], connID)
-			delete(ui.conns, connID)
-			ui.Log.Printf("IRC: I/O error, dropped connection %s: %v", connID, err)
+	}
+}
+
+// TopicChanged sends TOPIC to clients that joined the channel. Unlike other
+// messages, our own changes are sent too as clients expect the server to
+// confirm them.
+func (ui *UI) TopicChanged(buffer, author string, meta infchat.ChannelMeta) {
+	ui.connsLck.Lock()
+	defer ui.connsLck.Unlock()
+
+	for connID, c := range ui.joined[buffer] {
+		ui.write(buffer, connID, c, &irc.Message{
+			Prefix: &irc.Prefix{
+				Name: author,
+			},
+			Command: "TOPIC",
+			Params:  []string{buffer, meta.Topic},
+		})
+	}
+}
+
+func (ui *UI) DeleteMsg(buffer, sender, msgID string) {
+	if buffer == "" {
+		return
+	}
+	own := sender == ui.Node.DisplayName(ui.Node.ID())
+
+	ui.connsLck.Lock()
+	defer ui.connsLck.Unlock()
+
+	conns, target := ui.targets(buffer)
+	for connID, c := range conns {
+		msg := &irc.Message{
+			Prefix: &irc.Prefix{
+				Name: sender,
+			},
+		}
+		switch {
+		case c.Caps.has("draft/message-redaction"):
+			msg.Command = "REDACT"
+			msg.Params = []string{target, msgID}
+		case !own:
+			msg.Command = "NOTICE"
+			msg.Params = []string{target, "(deleted message " + msgID + ")"}
+		default:
+			continue
 		}
-		c.Net.SetWriteDeadline(time.Time{})
+		ui.write(buffer, connID, c, msg)
+	}
+}
+
+func (ui *UI) Joined(buffer, name string) {
+	ui.membership("JOIN", buffer, name)
+}
+
+func (ui *UI) Parted(buffer, name string) {
+	ui.membership("PART", buffer, name)
+}
+
+func (ui *UI) membership(command, buffer, name string) {
+	ui.connsLck.Lock()
+	defer ui.connsLck.Unlock()
+
+	for connID, c := range ui.joined[buffer] {
+		ui.write(buffer, connID, c, &irc.Message{
+			Prefix: &irc.Prefix{
+				Name: name,
+			},
+			Command: command,
+			Params:  []string{buffer},
+		})
 	}
 }
 
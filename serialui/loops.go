@@ -1,6 +1,7 @@
 package serialui
 
 import (
+	"fmt"
 	"strings"
 
 	infchat "github.com/foxcpp/infinitychat/node"
@@ -26,16 +27,17 @@ func InputLoop(ui UI, node *infchat.Node) {
 				ui.Msg(bufferName, "local", "You shout in the empty field with noone to hear you... use /join <channel>")
 				continue
 			}
-			descr, err := infchat.ExpandDescriptor(bufferName)
+			descr, err := node.ExpandDescriptor(bufferName)
 			if err != nil {
 				ui.Error(bufferName, "Post failed: invalid buffer: %v", err)
 				continue
 			}
-			if err := node.Post(descr, t); err != nil {
+			d, err := node.Post(descr, t)
+			if err != nil {
 				ui.Error(bufferName, "Post failed: %v", err)
 				continue
 			}
-			ui.Msg(bufferName, node.ID().String(), t)
+			showOwn(ui, node, bufferName, d, t)
 			continue
 		}
 
@@ -49,8 +51,201 @@ func InputLoop(ui UI, node *infchat.Node) {
 	}
 }
 
-func PullMessages(ui UI, node *infchat.Node) {
-	for msg := range node.Messages() {
-		ui.Msg(infchat.DescriptorForDisplay(msg.Channel), msg.Sender.String(), "%s", msg.Text)
+func PullEvents(ui UI, node *infchat.Node) {
+	sub, err := node.Subscribe(infchat.EventFilter{
+		Types: []infchat.EventType{
+			infchat.EventMessage,
+			infchat.EventChannelPeer,
+			infchat.EventDelivery,
+			infchat.EventTyping,
+			infchat.EventChannelMeta,
+		},
+	})
+	if err != nil {
+		ui.Error("", "%v", err)
+		return
+	}
+	defer sub.Close()
+
+	for ev := range sub.Events() {
+		switch ev := ev.(type) {
+		case infchat.MessageEvent:
+			ShowMessage(ui, node, ev.Message)
+		case infchat.ChannelPeerEvent:
+			showMembership(ui, node, ev)
+		case infchat.DeliveryEvent:
+			if dui, ok := ui.(DeliveryUI); ok {
+				dui.SetDeliveryState(ev.MessageID, ev.State)
+			}
+			if ev.State == infchat.DeliveryFailed {
+				ui.Error(node.DescriptorForDisplay(ev.Channel), "Message %s was not delivered: %v", ev.MessageID, ev.Err)
+			}
+		case infchat.TypingEvent:
+			if tyui, ok := ui.(TypingUI); ok {
+				tyui.Typing(node.DescriptorForDisplay(ev.Channel), node.DisplayName(ev.Peer), ev.State)
+			}
+		case infchat.ChannelMetaEvent:
+			showTopic(ui, node, ev)
+		}
+	}
+}
+
+// showOwn renders the message we just posted.
+func showOwn(ui UI, node *infchat.Node, buf string, d *infchat.Delivery, text string) {
+	sender := node.DisplayName(node.ID())
+
+	dui, ok := ui.(DeliveryUI)
+	if !ok {
+		ui.Msg(buf, sender, "%s%s", replyPrefix(d.Message.ReplyTo), text)
+		return
+	}
+
+	dui.OwnMsg(buf, sender, d.Message.ID, d.Message.ReplyTo, text)
+	// Message might be already sent before the line was added.
+	state, _, _ := d.State()
+	dui.SetDeliveryState(d.Message.ID, state)
+}
+
+func showMembership(ui UI, node *infchat.Node, ev infchat.ChannelPeerEvent) {
+	buf := node.DescriptorForDisplay(ev.Channel)
+	name := node.DisplayName(ev.Peer)
+
+	if mui, ok := ui.(MembershipUI); ok {
+		if ev.Joined {
+			mui.Joined(buf, name)
+		} else {
+			mui.Parted(buf, name)
+		}
+		return
+	}
+
+	if ev.Joined {
+		ui.Msg(buf, "local", "%s has joined %s", name, buf)
+	} else {
+		ui.Msg(buf, "local", "%s has left %s", name, buf)
+	}
+}
+
+func showTopic(ui UI, node *infchat.Node, ev infchat.ChannelMetaEvent) {
+	buf := node.DescriptorForDisplay(ev.Channel)
+	author := node.DisplayName(ev.Meta.Author)
+
+	if tui, ok := ui.(TopicUI); ok {
+		tui.TopicChanged(buf, author, ev.Meta)
+		return
+	}
+
+	if ev.Meta.Topic == "" {
+		ui.Msg(buf, "local", "%s cleared the topic", author)
+		return
+	}
+	ui.Msg(buf, "local", "%s changed the topic to: %s", author, ev.Meta.Topic)
+}
+
+// ShowMessage renders the received message in the corresponding buffer.
+func ShowMessage(ui UI, node *infchat.Node, msg infchat.Message) {
+	buf := node.DescriptorForDisplay(msg.Channel)
+	sender := node.DisplayName(msg.Sender)
+	if msg.Unverified {
+		// Only the relaying peer claims the message is from the sender.
+		sender += " via " + node.DisplayName(msg.RelayedBy)
+	}
+
+	mui, tracked := ui.(MessageUI)
+	switch msg.Kind {
+	case infchat.KindEdit:
+		if tracked {
+			mui.EditMsg(buf, sender, msg.Target, msg.Text)
+			return
+		}
+		ui.Msg(buf, "local", "%s edited message %s: %s", sender, msg.Target, msg.Text)
+		return
+	case infchat.KindDelete:
+		if tracked {
+			mui.DeleteMsg(buf, sender, msg.Target)
+			return
+		}
+		ui.Msg(buf, "local", "%s deleted message %s", sender, msg.Target)
+		return
+	case infchat.KindReaction:
+		showReaction(ui, node, buf, sender, msg.Target, msg.Text)
+		return
+	case infchat.KindTopic:
+		// Shown by showTopic if the change is accepted.
+		return
+	}
+
+	if msg.RelayedBy != "" {
+		// Message was sent before we joined, show when it happened.
+		msg.Text = "[" + msg.Timestamp.Format("2006-01-02 15:04:05") + "] " + msg.Text
+	}
+	text := msg.Text
+	switch {
+	case msg.Kind == infchat.KindAction:
+		text = "* " + text
+	case msg.Kind == infchat.KindFile && msg.File != nil:
+		short := msg.ID
+		if len(short) > 8 {
+			short = short[:8]
+		}
+		text = fmt.Sprintf("* offers %s (%s), use /accept %s to download it", msg.File.Name, formatSize(msg.File.Size), short)
+	}
+	if tracked {
+		mui.ChatMsg(buf, sender, msg.ID, msg.ReplyTo, text)
+	} else {
+		ui.Msg(buf, sender, "%s%s", replyPrefix(msg.ReplyTo), text)
+	}
+	showAttachments(ui, buf, msg.ID, msg.Attachments)
+}
+
+func describeAttachment(info infchat.FileInfo) string {
+	hash := info.Hash
+	if len(hash) > 16 {
+		hash = hash[:16]
+	}
+	return fmt.Sprintf("%s (%s, sha256 %s)", info.Name, formatSize(info.Size), hash)
+}
+
+// showAttachments lists attachments of the shown message.
+func showAttachments(ui UI, buf, msgID string, infos []infchat.FileInfo) {
+	if len(infos) == 0 {
+		return
+	}
+	descriptions := make([]string, 0, len(infos))
+	for _, info := range infos {
+		descriptions = append(descriptions, describeAttachment(info))
+	}
+	if aui, ok := ui.(AttachmentUI); ok {
+		aui.Attached(msgID, descriptions)
+		return
+	}
+
+	short := msgID
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	for i, descr := range descriptions {
+		ui.Msg(buf, "local", "Attachment %d of %s: %s", i+1, short, descr)
+	}
+	ui.Msg(buf, "local", "Use /fetch %s [number] to download it", short)
+}
+
+func showReaction(ui UI, node *infchat.Node, buf, sender, msgID, reaction string) {
+	if rui, ok := ui.(ReactionUI); ok {
+		rui.Reacted(buf, sender, msgID, reaction, node.Reactions(msgID))
+		return
+	}
+	ui.Msg(buf, "local", "%s reacted to message %s with %s", sender, msgID, reaction)
+}
+
+// replyPrefix is shown before replies by UIs that do not keep track of
+// messages.
+func replyPrefix(replyTo string) string {
+	if replyTo == "" {
+		return ""
+	}
+	if len(replyTo) > 8 {
+		replyTo = replyTo[:8]
 	}
+	return "(re " + replyTo + ") "
 }
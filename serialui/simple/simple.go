@@ -71,7 +71,7 @@ func (ui *UI) msg(buffer, sender string, escape bool, format string, args ...int
 	} else if buffer == "" || buffer == ui.CurrentBuffer() {
 		prefixBraces = "<" + sender + ">"
 	} else {
-		prefixBraces = "<" + buffer + ":" + sender + ">"
+		prefixBraces = "<" + infchat.RedactDescriptor(buffer) + ":" + sender + ">"
 	}
 
 	var msgBuffer bytes.Buffer
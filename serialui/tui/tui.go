@@ -1,12 +1,14 @@
 package tui
 
 import (
-	"bytes"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	infchat "github.com/foxcpp/infinitychat/node"
@@ -14,6 +16,53 @@ import (
 	"github.com/rivo/tview"
 )
 
+const banner = " _        __         _           _   \n" +
+	"(_)_ __  / _|    ___| |__   __ _| |_ \n" +
+	"| | '_ \\| |_    / __| '_ \\ / _` | __|\n" +
+	"| | | | |  _|  | (__| | | | (_| | |_ \n" +
+	"|_|_| |_|_|(_)  \\___|_| |_|\\__,_|\\__|\n" +
+	"InfinityChat v0.1 | Because ZeroChat is too small ;D\n\n"
+
+const (
+	// Maximum amount of entries kept in the log box. Once it is exceeded,
+	// logTrimEntries oldest ones are dropped at once, so the log box is
+	// rewritten only once in a while.
+	maxLogEntries  = 2000
+	logTrimEntries = 500
+)
+
+// logEntry is a single message in the log box, possibly spanning multiple
+// lines.
+type logEntry struct {
+	// Timestamp and sender, repeated for each line.
+	prefix string
+	lines  []string
+
+	// Set only for chat messages.
+	msgID  string
+	sender string
+	// Short reference shown next to the message, see ResolveRef.
+	ref int
+	// Shown before the text of replies.
+	reply string
+	// Reaction counters shown under the message.
+	reactions string
+	// Attachment descriptions shown under the message.
+	attachments []string
+	// Delivery state of our own message, empty for other messages.
+	state   infchat.DeliveryState
+	edited  bool
+	deleted bool
+
+	// Result of render, updated when the entry changes.
+	rendered string
+}
+
+type typingPeer struct {
+	state   infchat.TypingState
+	updated time.Time
+}
+
 type TUI struct {
 	app *tview.Application
 
@@ -22,7 +71,22 @@ type TUI struct {
 	logBox *tview.TextView
 	input  *tview.InputField
 
+	logLock      sync.Mutex
 	logLineCount int
+	entries      []logEntry
+	// Indexes of chat messages in entries, by message ID.
+	entryByID map[string]int
+	// Message IDs by short reference minus refBase minus one. References
+	// of trimmed entries are dropped.
+	refs    []string
+	refBase int
+	// Set if the log box rewrite is queued, see updateEntry.
+	redrawPending bool
+
+	// Status line and peers typing in each buffer, shown in the header.
+	headerLock sync.Mutex
+	statusLine string
+	typing     map[string]map[string]typingPeer
 
 	inputHistory      []string
 	inputHistoryIndex int
@@ -44,6 +108,9 @@ func New() *TUI {
 		logBox: tview.NewTextView(),
 		input:  tview.NewInputField(),
 		lines:  make(chan string, 100),
+
+		entryByID: make(map[string]int),
+		typing:    make(map[string]map[string]typingPeer),
 	}
 
 	tui.header.SetBackgroundColor(tcell.Color236)
@@ -58,12 +125,7 @@ func New() *TUI {
 	tui.logBox.SetWordWrap(true)
 	tui.logBox.SetBorder(true)
 	tui.logBox.SetBorderPadding(0, 1, 1, 1)
-	io.WriteString(tui.logBox, " _        __         _           _   \n"+
-		"(_)_ __  / _|    ___| |__   __ _| |_ \n"+
-		"| | '_ \\| |_    / __| '_ \\ / _` | __|\n"+
-		"| | | | |  _|  | (__| | | | (_| | |_ \n"+
-		"|_|_| |_|_|(_)  \\___|_| |_|\\__,_|\\__|\n"+
-		"InfinityChat v0.1 | Because ZeroChat is too small ;D\n\n")
+	io.WriteString(tui.logBox, banner)
 
 	tui.flex.AddItem(tui.header, 1, 1, false)
 	tui.flex.AddItem(tui.logBox, 0, 24, false)
@@ -82,6 +144,7 @@ func New() *TUI {
 			tui.input.SetText("")
 		}
 	})
+	tui.input.SetChangedFunc(tui.inputChanged)
 	tui.input.SetFieldBackgroundColor(tcell.Color236)
 	tui.input.SetFieldTextColor(tcell.Color255)
 	tui.input.SetLabel("> ")
@@ -142,12 +205,120 @@ func (tui *TUI) statusUpdate(node *infchat.Node) {
 			statusLine += ", impenetrable NAT detected"
 		}
 
-		tui.app.QueueUpdateDraw(func() {
-			tui.header.SetText(statusLine)
-		})
+		tui.headerLock.Lock()
+		tui.statusLine = statusLine
+		tui.headerLock.Unlock()
+		tui.redrawHeader()
+	}
+}
+
+// redrawHeader updates the header with the last status line, the topic of
+// the current buffer and peers typing in it.
+func (tui *TUI) redrawHeader() {
+	topic := tui.currentTopic()
+
+	tui.headerLock.Lock()
+	text := tui.statusLine
+	var names []string
+	for name, tp := range tui.typing[tui.CurrentBuffer()] {
+		expiry := infchat.TypingActiveExpiry
+		if tp.state == infchat.TypingPaused {
+			expiry = infchat.TypingPausedExpiry
+		}
+		if time.Since(tp.updated) > expiry {
+			delete(tui.typing[tui.CurrentBuffer()], name)
+			continue
+		}
+		if tp.state == infchat.TypingActive {
+			names = append(names, name)
+		}
+	}
+	tui.headerLock.Unlock()
+
+	if topic != "" {
+		text += " | " + topic
+	}
+	switch len(names) {
+	case 0:
+	case 1:
+		text += " | " + names[0] + " is typing…"
+	default:
+		sort.Strings(names)
+		text += " | " + strings.Join(names, ", ") + " are typing…"
+	}
+
+	if !tui.running {
+		return
+	}
+	tui.app.QueueUpdateDraw(func() {
+		tui.header.SetText(text)
+	})
+}
+
+func (tui *TUI) currentTopic() string {
+	if tui.node == nil || tui.CurrentBuffer() == "" {
+		return ""
+	}
+	descr, err := tui.node.ExpandDescriptor(tui.CurrentBuffer())
+	if err != nil {
+		return ""
+	}
+	meta, ok := tui.node.ChannelMeta(descr)
+	if !ok {
+		return ""
+	}
+	return meta.Topic
+}
+
+// TopicChanged shows the topic change in the log, the topic itself is shown
+// in the header.
+func (tui *TUI) TopicChanged(buffer, author string, meta infchat.ChannelMeta) {
+	if meta.Topic == "" {
+		tui.Msg(buffer, "local", "%s cleared the topic", author)
+	} else {
+		tui.Msg(buffer, "local", "%s changed the topic to: %s", author, meta.Topic)
+	}
+	if buffer == tui.CurrentBuffer() {
+		tui.redrawHeader()
+	}
+}
+
+// Typing updates the typing state of the peer shown in the header.
+func (tui *TUI) Typing(buffer, sender string, state infchat.TypingState) {
+	tui.headerLock.Lock()
+	if state == infchat.TypingDone {
+		delete(tui.typing[buffer], sender)
+	} else {
+		if tui.typing[buffer] == nil {
+			tui.typing[buffer] = make(map[string]typingPeer)
+		}
+		tui.typing[buffer][sender] = typingPeer{state: state, updated: time.Now()}
+	}
+	tui.headerLock.Unlock()
+
+	if buffer == tui.CurrentBuffer() {
+		tui.redrawHeader()
 	}
 }
 
+// inputChanged notifies members of the current buffer that we are typing.
+// Commands are not considered typing.
+func (tui *TUI) inputChanged(text string) {
+	if tui.node == nil || tui.CurrentBuffer() == "" {
+		return
+	}
+	descr, err := tui.node.ExpandDescriptor(tui.CurrentBuffer())
+	if err != nil {
+		return
+	}
+	state := infchat.TypingActive
+	if text == "" || strings.HasPrefix(text, "/") {
+		state = infchat.TypingDone
+	}
+	// Failures are not interesting, e.g. the channel is not joined.
+	tui.node.SetTyping(descr, state)
+}
+
 func (tui *TUI) Write(b []byte) (int, error) {
 	tui.Msg("", "local", "%v", string(b))
 	return 0, nil
@@ -193,43 +364,310 @@ func pickColor(ourId, prefix string) string {
 }
 
 func (tui *TUI) msg(buffer, sender string, escape bool, format string, args ...interface{}) {
-	msg := fmt.Sprintf(format, args...)
-	msg = strings.TrimRight(msg, "\n\t ")
+	tui.addEntry(buffer, sender, "", "", "", fmt.Sprintf(format, args...))
+}
 
-	lines := strings.Split(msg, "\n")
-	stamp := time.Now().Format("[#dadada]15[#8a8a8a]:[#dadada]04[#8a8a8a]:[#dadada]05[-]")
+// ChatMsg adds the line for the received message, it can be later changed
+// using EditMsg and DeleteMsg.
+func (tui *TUI) ChatMsg(buffer, sender, msgID, replyTo, text string) {
+	// Typing notifications are not sent after the message.
+	tui.Typing(buffer, sender, infchat.TypingDone)
+	tui.addEntry(buffer, sender, msgID, replyTo, "", text)
+}
 
-	shouldScroll := false
+// OwnMsg adds the line for the message we posted, it is marked as pending
+// until SetDeliveryState is called.
+func (tui *TUI) OwnMsg(buffer, sender, msgID, replyTo, text string) {
+	tui.addEntry(buffer, sender, msgID, replyTo, infchat.DeliveryPending, text)
+}
+
+// ResolveRef returns the ID of the message shown with the specified number.
+func (tui *TUI) ResolveRef(ref string) (string, bool) {
+	n, err := strconv.Atoi(ref)
+	if err != nil {
+		return "", false
+	}
+
+	tui.logLock.Lock()
+	defer tui.logLock.Unlock()
+	n -= tui.refBase
+	if n <= 0 || n > len(tui.refs) {
+		return "", false
+	}
+	return tui.refs[n-1], true
+}
+
+// replyLabel describes the message replied to. logLock should be held.
+func (tui *TUI) replyLabel(replyTo string) string {
+	i, ok := tui.entryByID[replyTo]
+	if !ok {
+		if len(replyTo) > 8 {
+			replyTo = replyTo[:8]
+		}
+		return "[#8a8a8a]re " + replyTo + ":[-] "
+	}
+	return fmt.Sprintf("[#8a8a8a]re %d %s:[-] ", tui.entries[i].ref, tview.Escape(tui.entries[i].sender))
+}
+
+// updateEntry calls change for the message entry and redraws the log box. It
+// returns false if the message is not shown.
+//
+// Only the changed entry is rendered again. Changes often come in bursts
+// (e.g. delivery states or reactions), so the log box rewrite is queued and
+// done once for all changes made before the UI gets to it.
+func (tui *TUI) updateEntry(msgID string, change func(e *logEntry) bool) bool {
+	tui.logLock.Lock()
+	i, ok := tui.entryByID[msgID]
+	if !ok {
+		tui.logLock.Unlock()
+		return false
+	}
+	if !change(&tui.entries[i]) {
+		tui.logLock.Unlock()
+		return true
+	}
+	tui.entries[i].rendered = tui.entries[i].render()
+
+	if !tui.running {
+		tui.redrawLocked()
+		tui.logLock.Unlock()
+		return true
+	}
+	queue := !tui.redrawPending
+	tui.redrawPending = true
+	tui.logLock.Unlock()
+
+	if queue {
+		tui.app.QueueUpdateDraw(func() {
+			tui.logLock.Lock()
+			defer tui.logLock.Unlock()
+			tui.redrawPending = false
+			tui.redrawLocked()
+		})
+	}
+	return true
+}
+
+// SetDeliveryState updates the marker next to our own message.
+func (tui *TUI) SetDeliveryState(msgID string, state infchat.DeliveryState) {
+	tui.updateEntry(msgID, func(e *logEntry) bool {
+		if e.state == "" || e.state == state {
+			return false
+		}
+		e.state = state
+		return true
+	})
+}
+
+// EditMsg replaces the text of the previously shown message.
+func (tui *TUI) EditMsg(buffer, sender, msgID, text string) {
+	found := tui.updateEntry(msgID, func(e *logEntry) bool {
+		if e.deleted {
+			return false
+		}
+		e.lines = strings.Split(strings.TrimRight(text, "\n\t "), "\n")
+		e.edited = true
+		return true
+	})
+	if !found {
+		tui.Msg(buffer, "local", "%s edited message %s: %s", sender, msgID, text)
+	}
+}
+
+// Reacted updates reaction counters shown under the message.
+func (tui *TUI) Reacted(buffer, sender, msgID, reaction string, counts []infchat.ReactionCount) {
+	parts := make([]string, 0, len(counts))
+	for _, rc := range counts {
+		parts = append(parts, fmt.Sprintf("%s %d", tview.Escape(rc.Reaction), rc.Count))
+	}
+	found := tui.updateEntry(msgID, func(e *logEntry) bool {
+		e.reactions = strings.Join(parts, "  ")
+		return true
+	})
+	if !found {
+		tui.Msg(buffer, "local", "%s reacted to message %s with %s", sender, msgID, reaction)
+	}
+}
+
+// Attached shows attachments of the message under it, they are fetched
+// using /fetch.
+func (tui *TUI) Attached(msgID string, descriptions []string) {
+	tui.updateEntry(msgID, func(e *logEntry) bool {
+		e.attachments = descriptions
+		return true
+	})
+}
+
+// DeleteMsg replaces the text of the previously shown message with the
+// deletion marker.
+func (tui *TUI) DeleteMsg(buffer, sender, msgID string) {
+	found := tui.updateEntry(msgID, func(e *logEntry) bool {
+		e.deleted = true
+		return true
+	})
+	if !found {
+		tui.Msg(buffer, "local", "%s deleted message %s", sender, msgID)
+	}
+}
+
+func deliveryMarker(state infchat.DeliveryState) string {
+	switch state {
+	case infchat.DeliveryPending:
+		return " [#8a8a8a](pending)[-]"
+	case infchat.DeliveryFailed:
+		return " [#fe3333](not delivered)[-]"
+	default:
+		return ""
+	}
+}
+
+func (e logEntry) render() string {
+	if e.deleted {
+		return e.prefix + " [#8a8a8a](message deleted)[-]\n"
+	}
+
+	var buf strings.Builder
+	for i, line := range e.lines {
+		buf.WriteString(e.prefix + " ")
+		if i == 0 {
+			buf.WriteString(e.reply)
+		}
+		buf.WriteString(line + "[-]")
+		if i == len(e.lines)-1 {
+			// Markers go after the last line of the message.
+			if e.edited {
+				buf.WriteString(" [#8a8a8a](edited)[-]")
+			}
+			buf.WriteString(deliveryMarker(e.state))
+		}
+		buf.WriteString("\n")
+	}
+	for i, descr := range e.attachments {
+		fmt.Fprintf(&buf, "         [#8a8a8a]attachment %d:[-] %s\n", i+1, tview.Escape(descr))
+	}
+	if e.reactions != "" {
+		// Aligned with the sender.
+		buf.WriteString("         [#8a8a8a]" + e.reactions + "[-]\n")
+	}
+	return buf.String()
+}
+
+// redrawLocked replaces the log box contents with all entries. It is used
+// when an already shown entry changes, TextView can not replace a part of
+// its text. logLock should be held.
+func (tui *TUI) redrawLocked() {
 	scrollLine, _ := tui.logBox.GetScrollOffset()
-	if scrollLine == tui.logLineCount {
-		shouldScroll = true
+	shouldScroll := scrollLine == tui.logLineCount
+
+	size := len(banner)
+	for _, e := range tui.entries {
+		size += len(e.rendered)
+	}
+	var buf strings.Builder
+	buf.Grow(size)
+	buf.WriteString(banner)
+	tui.logLineCount = 0
+	for _, e := range tui.entries {
+		buf.WriteString(e.rendered)
+		tui.logLineCount += strings.Count(e.rendered, "\n")
+	}
+	tui.logBox.SetText(buf.String())
+
+	if shouldScroll {
+		tui.logBox.ScrollToEnd()
+	}
+}
+
+// trimLocked drops the oldest entries if there are too many of them. It
+// returns true if the log box was rewritten. logLock should be held.
+func (tui *TUI) trimLocked() bool {
+	if len(tui.entries) <= maxLogEntries {
+		return false
 	}
 
+	tui.entries = append([]logEntry(nil), tui.entries[logTrimEntries:]...)
+
+	tui.entryByID = make(map[string]int, len(tui.entries))
+	minRef := tui.refBase + len(tui.refs) + 1
+	for i, e := range tui.entries {
+		if e.msgID == "" {
+			continue
+		}
+		tui.entryByID[e.msgID] = i
+		if e.ref < minRef {
+			minRef = e.ref
+		}
+	}
+	dropRefs := minRef - 1 - tui.refBase
+	tui.refs = append([]string(nil), tui.refs[dropRefs:]...)
+	tui.refBase += dropRefs
+
+	tui.redrawLocked()
+	return true
+}
+
+func (tui *TUI) addEntry(buffer, sender, msgID, replyTo string, state infchat.DeliveryState, msg string) {
+	msg = strings.TrimRight(msg, "\n\t ")
+
+	lines := strings.Split(msg, "\n")
+	stamp := time.Now().Format("[#dadada]15[#8a8a8a]:[#dadada]04[#8a8a8a]:[#dadada]05[-]")
+
 	var prefixBraces string
 	if sender == "local" {
 		prefixBraces = tview.Escape("[local]")
 	} else if buffer == "" || buffer == tui.CurrentBuffer() {
-		prefixBraces = "<" + sender + ">"
+		prefixBraces = tview.Escape("<" + sender + ">")
 	} else {
-		prefixBraces = "<" + buffer + ":" + sender + ">"
+		prefixBraces = tview.Escape("<" + infchat.RedactDescriptor(buffer) + ":" + sender + ">")
+	}
+	var ourName string
+	if tui.node != nil {
+		// Not set yet if we are called before Run (e.g. during key loading).
+		ourName = tui.node.DisplayName(tui.node.ID())
 	}
-	color := pickColor(tui.node.ID().String(), sender)
+	color := pickColor(ourName, sender)
 
-	var msgBuffer bytes.Buffer
+	tui.logLock.Lock()
 
-	for _, line := range lines {
-		if !tui.running {
+	shouldScroll := false
+	scrollLine, _ := tui.logBox.GetScrollOffset()
+	if scrollLine == tui.logLineCount {
+		shouldScroll = true
+	}
+
+	if !tui.running {
+		for _, line := range lines {
 			fmt.Fprintf(os.Stderr, "%v [%s] %s\n", time.Now().Format("15:04:05"), sender, line)
 		}
-		fmt.Fprintf(&msgBuffer, "%v [%s][::b]%s[#eeeeee::-] %s[-]\n", stamp, color, prefixBraces, line)
-		tui.logLineCount++
 	}
+	e := logEntry{
+		prefix: fmt.Sprintf("%v [%s][::b]%s[#eeeeee::-]", stamp, color, prefixBraces),
+		lines:  lines,
+		msgID:  msgID,
+		sender: sender,
+		state:  state,
+	}
+	if msgID != "" {
+		tui.refs = append(tui.refs, msgID)
+		e.ref = tui.refBase + len(tui.refs)
+		e.prefix = fmt.Sprintf("%v [#6c6c6c]%d[-] [%s][::b]%s[#eeeeee::-]", stamp, e.ref, color, prefixBraces)
+		tui.entryByID[msgID] = len(tui.entries)
+	}
+	if replyTo != "" {
+		e.reply = tui.replyLabel(replyTo)
+	}
+	e.rendered = e.render()
+	tui.entries = append(tui.entries, e)
 
-	if shouldScroll {
-		tui.logBox.ScrollToEnd()
+	if !tui.trimLocked() {
+		tui.logLineCount += strings.Count(e.rendered, "\n")
+		if shouldScroll {
+			tui.logBox.ScrollToEnd()
+		}
+		io.WriteString(tui.logBox, e.rendered)
 	}
 
-	tui.logBox.Write(msgBuffer.Bytes())
+	tui.logLock.Unlock()
 
 	if tui.running {
 		tui.app.Draw()
@@ -237,7 +675,7 @@ func (tui *TUI) msg(buffer, sender string, escape bool, format string, args ...i
 }
 
 func (tui *TUI) ReadLine() (string, string, error) {
-	tui.input.SetLabel(infchat.DescriptorForDisplay(tui.currentBuffer) + " > ")
+	tui.input.SetLabel(infchat.RedactDescriptor(tui.currentBuffer) + " > ")
 	return tui.currentBuffer, <-tui.lines, nil
 }
 
@@ -4,6 +4,10 @@
 // Subpackages provide implemenations of primitives used by this package.
 package serialui
 
+import (
+	infchat "github.com/foxcpp/infinitychat/node"
+)
+
 // TODO: Proper documentation for serial UI model.
 
 type UI interface {
@@ -19,3 +23,71 @@ type UI interface {
 
 	Close() error
 }
+
+// MembershipUI can be implemented by UI to render channel membership changes
+// in its own way. Otherwise, they are shown as local messages in the channel
+// buffer.
+type MembershipUI interface {
+	Joined(buffer, name string)
+	Parted(buffer, name string)
+}
+
+// DeliveryUI can be implemented by UI to show the delivery state next to
+// messages we posted.
+type DeliveryUI interface {
+	// OwnMsg is used instead of Msg for messages we posted, the line is
+	// initially marked as pending. replyTo is the ID of the message this one
+	// replies to, if any.
+	OwnMsg(buffer, sender, msgID, replyTo, text string)
+	SetDeliveryState(msgID string, state infchat.DeliveryState)
+}
+
+// MessageUI can be implemented by UI to keep track of shown chat messages so
+// they can be updated in place when edited or deleted. Otherwise, changes are
+// shown as separate local messages.
+type MessageUI interface {
+	// ChatMsg is used instead of Msg for received chat messages. replyTo is
+	// the ID of the message this one replies to, if any.
+	ChatMsg(buffer, sender, msgID, replyTo, text string)
+	EditMsg(buffer, sender, msgID, text string)
+	DeleteMsg(buffer, sender, msgID string)
+}
+
+// RefUI can be implemented by UI that shows short references next to
+// messages so they can be used in commands instead of message IDs.
+type RefUI interface {
+	// ResolveRef returns the ID of the message shown with the reference.
+	ResolveRef(ref string) (msgID string, ok bool)
+}
+
+// ReactionUI can be implemented by UI to show reactions next to messages.
+// Otherwise, they are shown as local messages.
+type ReactionUI interface {
+	// Reacted is called when sender reacts to the message, counts contains
+	// all known reactions to the message.
+	Reacted(buffer, sender, msgID, reaction string, counts []infchat.ReactionCount)
+}
+
+// AttachmentUI can be implemented by UI to show attachments under messages.
+// Otherwise, they are listed as local messages after the message.
+type AttachmentUI interface {
+	// Attached is called after the message is shown, descriptions contain
+	// the name, size and hash of each attachment.
+	Attached(msgID string, descriptions []string)
+}
+
+// TypingUI can be implemented by UI to show that peers are typing. Typing
+// notifications are not shown by other UIs.
+type TypingUI interface {
+	// Typing is called on each notification, UI is responsible for
+	// expiring the state, see infchat.TypingActiveExpiry.
+	Typing(buffer, sender string, state infchat.TypingState)
+}
+
+// TopicUI can be implemented by UI to show the channel topic separately
+// (e.g. in the header). Otherwise, topic changes are shown as local messages.
+type TopicUI interface {
+	// TopicChanged is called when the channel metadata is changed by author
+	// or received from other members after join.
+	TopicChanged(buffer, author string, meta infchat.ChannelMeta)
+}